@@ -0,0 +1,168 @@
+package s3site
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Archive formats understood by openArchive
+const (
+	archiveFormatZip    = "zip"
+	archiveFormatTar    = "tar"
+	archiveFormatTarGz  = "tar.gz"
+	archiveFormatTarXz  = "tar.xz"
+	archiveFormatTarZst = "tar.zst"
+)
+
+var archiveFormats = []string{
+	archiveFormatZip,
+	archiveFormatTar,
+	archiveFormatTarGz,
+	archiveFormatTarXz,
+	archiveFormatTarZst,
+}
+
+// File name suffixes of each archive format, checked in order
+var archiveExtensions = []struct {
+	suffix string
+	format string
+}{
+	{".zip", archiveFormatZip},
+	{".tar.gz", archiveFormatTarGz},
+	{".tgz", archiveFormatTarGz},
+	{".tar.xz", archiveFormatTarXz},
+	{".txz", archiveFormatTarXz},
+	{".tar.zst", archiveFormatTarZst},
+	{".tar.zstd", archiveFormatTarZst},
+	{".tzst", archiveFormatTarZst},
+	{".tar", archiveFormatTar},
+}
+
+// Leading bytes of each compressed archive format
+var archiveMagicBytes = []struct {
+	magic  []byte
+	format string
+}{
+	{[]byte("PK\x03\x04"), archiveFormatZip},
+	{[]byte("PK\x05\x06"), archiveFormatZip},
+	{[]byte{0x1f, 0x8b}, archiveFormatTarGz},
+	{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, archiveFormatTarXz},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, archiveFormatTarZst},
+}
+
+// detectArchiveFormat guesses the format of an archive from its file name,
+// falling back to the magic bytes at the start of the file.
+func detectArchiveFormat(archive string) (string, error) {
+	name := strings.ToLower(archive)
+	for _, extension := range archiveExtensions {
+		if strings.HasSuffix(name, extension.suffix) {
+			return extension.format, nil
+		}
+	}
+
+	file, err := os.Open(archive)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	header := make([]byte, 512)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	header = header[:n]
+
+	for _, magic := range archiveMagicBytes {
+		if bytes.HasPrefix(header, magic.magic) {
+			return magic.format, nil
+		}
+	}
+
+	// Uncompressed tarballs carry the ustar magic in the first header block
+	if len(header) >= 262 && string(header[257:262]) == "ustar" {
+		return archiveFormatTar, nil
+	}
+
+	return "", fmt.Errorf("unable to detect the archive format of %s, set `archive_format` to one of %s",
+		archive, strings.Join(archiveFormats, ", "))
+}
+
+// openArchive extracts archive into destination within limits. An empty
+// format is detected with detectArchiveFormat.
+func openArchive(archive string, format string, destination string, limits extractLimits) error {
+	if format == "" {
+		detected, err := detectArchiveFormat(archive)
+		if err != nil {
+			return err
+		}
+		format = detected
+	}
+
+	log.Printf("[DEBUG] Opening archive. path=%s, format=%s", archive, format)
+
+	e, err := newExtractor(archive, destination, limits)
+	if err != nil {
+		return err
+	}
+
+	if format == archiveFormatZip {
+		return e.extractZip()
+	}
+
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	switch format {
+	case archiveFormatTar:
+		return e.extractTar(file)
+	case archiveFormatTarGz:
+		decoder, err := gzip.NewReader(file)
+		if err != nil {
+			return fmt.Errorf("%s: failed to create gzip reader: %s", archive, err)
+		}
+		defer decoder.Close()
+
+		return e.extractTar(decoder)
+	case archiveFormatTarXz:
+		decoder, err := xz.NewReader(file)
+		if err != nil {
+			return fmt.Errorf("%s: failed to create xz reader: %s", archive, err)
+		}
+
+		return e.extractTar(decoder)
+	case archiveFormatTarZst:
+		decoder, err := zstd.NewReader(file)
+		if err != nil {
+			return fmt.Errorf("%s: failed to create zstd reader: %s", archive, err)
+		}
+		defer decoder.Close()
+
+		return e.extractTar(decoder)
+	default:
+		return fmt.Errorf("unsupported archive format %q", format)
+	}
+}
+
+// setArchiveFormat exposes the detected format of a downloaded artifact so it
+// can be handed to s3site_site together with its path.
+func setArchiveFormat(data *schema.ResourceData, archive string) {
+	format, err := detectArchiveFormat(archive)
+	if err != nil {
+		log.Printf("[WARN] %s", err)
+	}
+
+	data.Set("archive_format", format)
+}
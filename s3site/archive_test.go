@@ -0,0 +1,115 @@
+package s3site
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mholt/archiver"
+)
+
+var testArchiveFiles = []string{
+	"../test_resources/index.html",
+	"../test_resources/logo.svg",
+}
+
+func TestDetectArchiveFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3site-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := map[string]string{
+		"site.zip":     archiveFormatZip,
+		"site.TGZ":     archiveFormatTarGz,
+		"site.tar.xz":  archiveFormatTarXz,
+		"site.tar.zst": archiveFormatTarZst,
+		"site.tar":     archiveFormatTar,
+	}
+	for name, expected := range cases {
+		if format, _ := detectArchiveFormat(filepath.Join(dir, name)); format != expected {
+			t.Errorf("Invalid format for %s. expected=%s, actual=%s", name, expected, format)
+		}
+	}
+
+	// Without an extension the content decides
+	noExtension := filepath.Join(dir, "artifact")
+	if err := archiver.TarGz.Make(noExtension, testArchiveFiles); err != nil {
+		t.Fatal(err)
+	}
+	if format, err := detectArchiveFormat(noExtension); err != nil || format != archiveFormatTarGz {
+		t.Errorf("Invalid format detected from content. format=%s, err=%v", format, err)
+	}
+
+	unknown := filepath.Join(dir, "unknown")
+	if err := ioutil.WriteFile(unknown, []byte("not an archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := detectArchiveFormat(unknown); err == nil {
+		t.Error("Expected an error for unknown content")
+	}
+}
+
+func TestOpenArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3site-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archives := map[string]func(string) error{
+		"site.zip": func(p string) error { return archiver.Zip.Make(p, testArchiveFiles) },
+		"site.tar": func(p string) error { return archiver.Tar.Make(p, testArchiveFiles) },
+		"site.tgz": func(p string) error { return archiver.TarGz.Make(p, testArchiveFiles) },
+		"site.txz": func(p string) error { return archiver.TarXZ.Make(p, testArchiveFiles) },
+		"site.tar.zst": func(p string) error {
+			var tarball bytes.Buffer
+			if err := archiver.Tar.Write(&tarball, testArchiveFiles); err != nil {
+				return err
+			}
+			encoder, err := zstd.NewWriter(nil)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(p, encoder.EncodeAll(tarball.Bytes(), nil), 0644)
+		},
+	}
+
+	for name, create := range archives {
+		archive := filepath.Join(dir, name)
+		if err := create(archive); err != nil {
+			t.Fatalf("Unable to create %s: %s", name, err)
+		}
+
+		destination := filepath.Join(dir, name+"-extracted")
+		if err := openArchive(archive, "", destination, defaultExtractLimits); err != nil {
+			t.Errorf("Unable to open %s: %s", name, err)
+			continue
+		}
+
+		for _, file := range []string{"index.html", "logo.svg"} {
+			if _, err := os.Stat(filepath.Join(destination, file)); err != nil {
+				t.Errorf("Missing %s in %s: %s", file, name, err)
+			}
+		}
+	}
+}
+
+func TestArchiveFormatValidation(t *testing.T) {
+	validate := resourceSite().Schema["archive_format"].ValidateFunc
+
+	// Data sources export an empty format when detection fails
+	for _, format := range []string{"", archiveFormatTarGz} {
+		if _, errs := validate(format, "archive_format"); len(errs) > 0 {
+			t.Errorf("Format %q was rejected: %v", format, errs)
+		}
+	}
+
+	if _, errs := validate("rar", "archive_format"); len(errs) == 0 {
+		t.Error("Format rar was accepted")
+	}
+}
@@ -1,10 +1,13 @@
 package s3site
 
 import (
+	"context"
+	"errors"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/hashicorp/terraform/helper/resource"
 )
 
@@ -15,6 +18,27 @@ func isAWSErr(err error, code string, message string) bool {
 	return false
 }
 
+// isCanceledErr reports whether err comes from a cancelled context, either
+// directly or as the cause of an SDK error.
+func isCanceledErr(err error) bool {
+	for err != nil {
+		if errors.Is(err, context.Canceled) {
+			return true
+		}
+
+		var aerr awserr.Error
+		if !errors.As(err, &aerr) {
+			return false
+		}
+		if aerr.Code() == request.CanceledErrorCode {
+			return true
+		}
+		err = aerr.OrigErr()
+	}
+
+	return false
+}
+
 func retryOnAwsCode(code string, f func() (interface{}, error)) (interface{}, error) {
 	var resp interface{}
 	err := resource.Retry(1*time.Minute, func() *resource.RetryError {
@@ -0,0 +1,79 @@
+package s3site
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+// Algorithms used to detect content changes
+const (
+	// Compare the S3 ETag with one computed locally for the upload part size
+	checksumAlgorithmETag = "ETAG"
+	// Compare a SHA-256 of the whole file recorded in object metadata
+	checksumAlgorithmSHA256 = "SHA256"
+	// Compare a CRC32C of the whole file recorded in object metadata
+	checksumAlgorithmCRC32C = "CRC32C"
+)
+
+var checksumAlgorithms = []string{
+	checksumAlgorithmETag,
+	checksumAlgorithmSHA256,
+	checksumAlgorithmCRC32C,
+}
+
+// checksumMetadataKey is the user metadata an upload records its checksum in.
+func checksumMetadataKey(algorithm string) string {
+	switch algorithm {
+	case checksumAlgorithmSHA256:
+		return "s3site-sha256"
+	case checksumAlgorithmCRC32C:
+		return "s3site-crc32c"
+	default:
+		return metadataContentHash
+	}
+}
+
+// isChecksumMetadataKey reports whether key holds a provider recorded checksum.
+func isChecksumMetadataKey(key string) bool {
+	for _, algorithm := range checksumAlgorithms {
+		if strings.EqualFold(key, checksumMetadataKey(algorithm)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getChecksum returns the checksum of the file for the given algorithm. The
+// ETag algorithm reproduces S3 multipart ETags, the others hash the whole file
+// and are independent of how the object was uploaded.
+func (f fileInfo) getChecksum(algorithm string) (string, error) {
+	var h hash.Hash
+	switch algorithm {
+	case "", checksumAlgorithmETag:
+		return f.getMd5Checksum()
+	case checksumAlgorithmSHA256:
+		h = sha256.New()
+	case checksumAlgorithmCRC32C:
+		h = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	default:
+		return "", fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+
+	file, err := os.Open(f.FullPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,57 @@
+package s3site
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3site-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hello.txt")
+	if err := ioutil.WriteFile(path, []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi := fileInfo{FullPath: path, FileInfo: info}
+
+	cases := map[string]string{
+		checksumAlgorithmETag:   "5eb63bbbe01eeed093cb22bb8f5acdc3",
+		checksumAlgorithmSHA256: "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+		checksumAlgorithmCRC32C: "c99465aa",
+	}
+
+	for algorithm, expected := range cases {
+		checksum, err := fi.getChecksum(algorithm)
+		if err != nil {
+			t.Errorf("Unable to compute %s checksum: %s", algorithm, err)
+			continue
+		}
+
+		if checksum != expected {
+			t.Errorf("Invalid %s checksum. expected=%s, actual=%s", algorithm, expected, checksum)
+		}
+	}
+}
+
+func TestIsChecksumMetadataKey(t *testing.T) {
+	for _, key := range []string{"s3site-md5", "S3site-Sha256", "s3site-crc32c"} {
+		if !isChecksumMetadataKey(key) {
+			t.Errorf("Key not detected as checksum: %s", key)
+		}
+	}
+
+	if isChecksumMetadataKey(metadataEncryption) {
+		t.Errorf("Key wrongly detected as checksum: %s", metadataEncryption)
+	}
+}
@@ -6,10 +6,11 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 )
 
 func dataSourceArtifactory() *schema.Resource {
-	return &schema.Resource{
+	resource := &schema.Resource{
 		Read: dataSourceArtifactoryRead,
 
 		Schema: map[string]*schema.Schema{
@@ -33,29 +34,63 @@ func dataSourceArtifactory() *schema.Resource {
 				Type:     schema.TypeString,
 				Computed: true,
 			},
+			"archive_format": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"signature_artifact": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "A detached signature of the artifact in the same repository, verified against `public_keys`.",
+			},
+			"signature_path": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
 			// "files": {
 			// 	Type:     schema.TypeMap,
 			// 	Computed: true,
 			// },
 		},
 	}
+
+	for key, s := range artifactCheckSchema() {
+		resource.Schema[key] = s
+	}
+
+	return resource
 }
 
 func dataSourceArtifactoryRead(data *schema.ResourceData, meta interface{}) error {
 	data.SetId(fmt.Sprintf("%s/%s", data.Get("repository").(string), data.Get("artifact").(string)))
 
-	if err := prepareTmp(); err != nil {
+	downloadDir, err := downloadWorkspace(meta.(*Meta).WorkDir, data.Id())
+	if err != nil {
 		return err
 	}
 
-	// defer cleanTmp()
-
 	username := data.Get("username").(string)
 	password := data.Get("password").(string)
 	repository := data.Get("repository").(string)
 	artifact := data.Get("artifact").(string)
 
-	url := fmt.Sprintf("%s/%s", repository, artifact)
+	localArtifactPath := filepath.Join(downloadDir, filepath.Base(artifact))
+
+	signaturePath, err := downloadVerified(data, "signature_artifact", artifact, localArtifactPath, func(source string, localPath string) error {
+		return downloadArtifact(fmt.Sprintf("%s/%s", repository, source), username, password, localPath)
+	})
+	if err != nil {
+		return err
+	}
+
+	data.Set("path", localArtifactPath)
+	data.Set("signature_path", signaturePath)
+	setArchiveFormat(data, localArtifactPath)
+
+	return nil
+}
+
+func downloadArtifact(url string, username string, password string, localPath string) error {
 	request, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return err
@@ -74,15 +109,15 @@ func dataSourceArtifactoryRead(data *schema.ResourceData, meta interface{}) erro
 		return fmt.Errorf("Error downloading artifact. HttpStatusCode=%d", response.StatusCode)
 	}
 
-	localArtifactPath := fmt.Sprintf("%s/%s", tempDir, artifact)
-	if file, err := os.Create(localArtifactPath); err != nil {
+	if file, err := os.Create(localPath); err != nil {
 		return err
 	} else {
-		io.Copy(file, response.Body)
+		_, err := io.Copy(file, response.Body)
 		file.Close()
+		if err != nil {
+			return fmt.Errorf("Error downloading artifact %s: %s", url, err)
+		}
 	}
 
-	data.Set("path", localArtifactPath)
-
 	return nil
 }
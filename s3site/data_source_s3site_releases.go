@@ -0,0 +1,99 @@
+package s3site
+
+import (
+	"time"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func dataSourceReleases() *schema.Resource {
+	return &schema.Resource{
+		Read: dataSourceReleasesRead,
+
+		Schema: map[string]*schema.Schema{
+			"bucket": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "The S3 bucket the site is deployed to.",
+			},
+			"prefix": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "The key prefix the site is deployed under.",
+			},
+			"releases": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "The recorded releases of the site, the latest first.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"id": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The release id, usable as `rollback_to` of the site.",
+						},
+						"created_at": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						"source_path": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The archive the release was deployed from.",
+						},
+						"source_sha256": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The SHA-256 of the archive the release was deployed from.",
+						},
+						"source_dir": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The directory the release was deployed from.",
+						},
+						"rollback_of": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The release restored by this release, empty for regular deployments.",
+						},
+						"objects": {
+							Type:        schema.TypeInt,
+							Computed:    true,
+							Description: "The number of objects in the release.",
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func dataSourceReleasesRead(data *schema.ResourceData, meta interface{}) error {
+	s3Helper := meta.(*Meta).S3Helper
+
+	bucket := data.Get("bucket").(string)
+	prefix := data.Get("prefix").(string)
+
+	data.SetId(siteId(bucket, prefix))
+
+	releases, err := s3Helper.listReleases(bucket, prefix)
+	if err != nil {
+		return err
+	}
+
+	list := make([]interface{}, 0, len(releases))
+	for _, r := range releases {
+		list = append(list, map[string]interface{}{
+			"id":            r.ID,
+			"created_at":    r.CreatedAt.UTC().Format(time.RFC3339),
+			"source_path":   r.Source.Path,
+			"source_sha256": r.Source.SHA256,
+			"source_dir":    r.Source.SourceDir,
+			"rollback_of":   r.Source.RollbackOf,
+			"objects":       len(r.Objects),
+		})
+	}
+	data.Set("releases", list)
+
+	return nil
+}
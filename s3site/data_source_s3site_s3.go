@@ -8,7 +8,7 @@ import (
 )
 
 func dataSourceS3() *schema.Resource {
-	return &schema.Resource{
+	resource := &schema.Resource{
 		Read: dataSourceS3Read,
 
 		Schema: map[string]*schema.Schema{
@@ -27,8 +27,29 @@ func dataSourceS3() *schema.Resource {
 				Computed:    true,
 				Description: "The local filesystem path where the artifact was downloaded.",
 			},
+			"archive_format": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The detected archive format of the artifact, empty when it could not be detected.",
+			},
+			"signature_key": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "The S3 object key of a detached signature of the artifact, verified against `public_keys`.",
+			},
+			"signature_path": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The local filesystem path where the signature was downloaded.",
+			},
 		},
 	}
+
+	for key, s := range artifactCheckSchema() {
+		resource.Schema[key] = s
+	}
+
+	return resource
 }
 
 func dataSourceS3Read(data *schema.ResourceData, meta interface{}) error {
@@ -39,17 +60,23 @@ func dataSourceS3Read(data *schema.ResourceData, meta interface{}) error {
 
 	data.SetId(fmt.Sprintf("s3://%s/%s", bucket, key))
 
-	if err := prepareTmp(); err != nil {
+	downloadDir, err := downloadWorkspace(meta.(*Meta).WorkDir, data.Id())
+	if err != nil {
 		return err
 	}
 
-	localPath := fmt.Sprintf("%s/%s", tempDir, filepath.Base(key))
+	localPath := filepath.Join(downloadDir, filepath.Base(key))
 
-	if err := s3Helper.GetObject(bucket, key, localPath); err != nil {
+	signaturePath, err := downloadVerified(data, "signature_key", key, localPath, func(source string, localPath string) error {
+		return s3Helper.GetObject(bucket, source, localPath)
+	})
+	if err != nil {
 		return err
 	}
 
 	data.Set("path", localPath)
+	data.Set("signature_path", signaturePath)
+	setArchiveFormat(data, localPath)
 
 	return nil
 }
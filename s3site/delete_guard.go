@@ -0,0 +1,50 @@
+package s3site
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Number of keys listed when a delete guard trips
+const deleteGuardKeys = 20
+
+// deleteGuard stops an apply from removing more objects from a site than
+// configured, which usually means a broken or empty artifact. Zero limits are
+// not enforced.
+type deleteGuard struct {
+	MaxCount   int
+	MaxPercent int
+	Override   bool
+}
+
+func siteDeleteGuard(d resourceGetter) deleteGuard {
+	return deleteGuard{
+		MaxCount:   d.Get("max_delete_count").(int),
+		MaxPercent: d.Get("max_delete_percent").(int),
+		Override:   d.Get("allow_large_delete").(bool),
+	}
+}
+
+// check returns an error when removing the keys from a site of total objects
+// exceeds a limit.
+func (g deleteGuard) check(removed []string, total int) error {
+	if g.Override || len(removed) == 0 {
+		return nil
+	}
+
+	var exceeded []string
+	if g.MaxCount > 0 && len(removed) > g.MaxCount {
+		exceeded = append(exceeded, fmt.Sprintf("max_delete_count of %d", g.MaxCount))
+	}
+	if g.MaxPercent > 0 && total > 0 && len(removed)*100 > g.MaxPercent*total {
+		exceeded = append(exceeded, fmt.Sprintf("max_delete_percent of %d%%", g.MaxPercent))
+	}
+
+	if len(exceeded) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("refusing to remove %d of %d objects, this exceeds the %s. Set allow_large_delete "+
+		"to remove them anyway: %s", len(removed), total, strings.Join(exceeded, " and the "),
+		strings.Join(truncateKeys(removed, deleteGuardKeys), ", "))
+}
@@ -0,0 +1,48 @@
+package s3site
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDeleteGuard(t *testing.T) {
+	var removed []string
+	for i := 0; i < 30; i++ {
+		removed = append(removed, fmt.Sprintf("static/%02d.js", i))
+	}
+
+	cases := []struct {
+		name  string
+		guard deleteGuard
+		total int
+		err   string
+	}{
+		{"disabled", deleteGuard{}, 30, ""},
+		{"count", deleteGuard{MaxCount: 10}, 100, "max_delete_count of 10"},
+		{"count within", deleteGuard{MaxCount: 30}, 100, ""},
+		{"percent", deleteGuard{MaxPercent: 25}, 100, "max_delete_percent of 25%"},
+		{"percent within", deleteGuard{MaxPercent: 30}, 100, ""},
+		{"both", deleteGuard{MaxCount: 10, MaxPercent: 10}, 100, "max_delete_count of 10 and the max_delete_percent of 10%"},
+		{"override", deleteGuard{MaxCount: 10, Override: true}, 100, ""},
+	}
+
+	for _, c := range cases {
+		err := c.guard.check(removed, c.total)
+		if c.err == "" {
+			if err != nil {
+				t.Errorf("Unexpected error for %s: %s", c.name, err)
+			}
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("Invalid error for %s: %v", c.name, err)
+			continue
+		}
+
+		if !strings.Contains(err.Error(), "static/00.js") || !strings.Contains(err.Error(), "and 10 more") {
+			t.Errorf("Error for %s does not list the keys: %s", c.name, err)
+		}
+	}
+}
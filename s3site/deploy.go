@@ -0,0 +1,113 @@
+package s3site
+
+import (
+	"context"
+	"log"
+)
+
+// defaultEntryPoints are used when the resource does not configure
+// `entry_points`.
+var defaultEntryPoints = []string{"**/*.html"}
+
+// siteEntryPoints returns the configured entry point patterns, falling back
+// to defaultEntryPoints.
+func siteEntryPoints(d resourceGetter) []string {
+	if patterns := expandStringList(d.Get("entry_points").([]interface{})); len(patterns) > 0 {
+		return patterns
+	}
+
+	return defaultEntryPoints
+}
+
+// splitEntryPoints separates the entry points of a site from the assets they
+// reference.
+func splitEntryPoints(fileMap map[string]fileInfo, patterns []string) (map[string]fileInfo, map[string]fileInfo) {
+	assets := make(map[string]fileInfo)
+	entryPoints := make(map[string]fileInfo)
+
+	for key, fi := range fileMap {
+		if isEntryPoint(fi.RelativePath, patterns) {
+			entryPoints[key] = fi
+		} else {
+			assets[key] = fi
+		}
+	}
+
+	return assets, entryPoints
+}
+
+func isEntryPoint(key string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if globMatch(pattern, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deploySite uploads the files in phases: assets first, then the entry points
+// once everything they reference is in place. Removing old objects is left to
+// the caller and must happen after this returns. The version ids of the
+// uploaded objects are returned by key, also for a partially failed deploy.
+func deploySite(ctx context.Context, s3Helper *S3Helper, fileMap map[string]fileInfo, bucket string, prefix string, entryPointPatterns []string, parallelism int) (map[string]string, error) {
+	assets, entryPoints := splitEntryPoints(fileMap, entryPointPatterns)
+	versions := make(map[string]string)
+
+	log.Printf("[INFO] Deploying assets. bucket=%s, prefix=%s, files=%d", bucket, prefix, len(assets))
+	assetVersions, err := s3Helper.BulkUploadS3Objects(ctx, assets, bucket, prefix, parallelism)
+	mergeVersions(versions, assetVersions)
+	if err != nil {
+		return versions, err
+	}
+
+	log.Printf("[INFO] Deploying entry points. bucket=%s, prefix=%s, files=%d", bucket, prefix, len(entryPoints))
+	entryPointVersions, err := s3Helper.BulkUploadS3Objects(ctx, entryPoints, bucket, prefix, parallelism)
+	mergeVersions(versions, entryPointVersions)
+
+	return versions, err
+}
+
+// restoreSite copies the objects back from the versions recorded for them,
+// in the same phases as deploySite.
+func restoreSite(ctx context.Context, s3Helper *S3Helper, objects map[string]siteObject, bucket string, prefix string, entryPointPatterns []string, parallelism int) (map[string]string, error) {
+	assets := make(map[string]siteObject)
+	entryPoints := make(map[string]siteObject)
+	for key, object := range objects {
+		if isEntryPoint(key, entryPointPatterns) {
+			entryPoints[key] = object
+		} else {
+			assets[key] = object
+		}
+	}
+	versions := make(map[string]string)
+
+	log.Printf("[INFO] Restoring assets. bucket=%s, prefix=%s, files=%d", bucket, prefix, len(assets))
+	assetVersions, err := s3Helper.CopyS3ObjectVersions(ctx, assets, bucket, prefix, parallelism)
+	mergeVersions(versions, assetVersions)
+	if err != nil {
+		return versions, err
+	}
+
+	log.Printf("[INFO] Restoring entry points. bucket=%s, prefix=%s, files=%d", bucket, prefix, len(entryPoints))
+	entryPointVersions, err := s3Helper.CopyS3ObjectVersions(ctx, entryPoints, bucket, prefix, parallelism)
+	mergeVersions(versions, entryPointVersions)
+
+	return versions, err
+}
+
+func mergeVersions(versions map[string]string, other map[string]string) {
+	for key, versionId := range other {
+		versions[key] = versionId
+	}
+}
+
+// setVersions records the version ids of uploaded objects in objects.
+func setVersions(objects map[string]siteObject, versions map[string]string) {
+	for key, versionId := range versions {
+		if object, ok := objects[key]; ok {
+			object.VersionId = versionId
+			objects[key] = object
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package s3site
+
+import (
+	"testing"
+)
+
+func TestSplitEntryPoints(t *testing.T) {
+	fileMap := map[string]fileInfo{
+		"index.html":          {RelativePath: "index.html"},
+		"docs/index.html":     {RelativePath: "docs/index.html"},
+		"static/app.js":       {RelativePath: "static/app.js"},
+		"manifest.json":       {RelativePath: "manifest.json"},
+		"static/vendor.js.gz": {RelativePath: "static/vendor.js.gz"},
+	}
+
+	assets, entryPoints := splitEntryPoints(fileMap, defaultEntryPoints)
+
+	if len(entryPoints) != 2 || len(assets) != 3 {
+		t.Errorf("Invalid split with default entry points. assets=%v, entryPoints=%v", assets, entryPoints)
+	}
+
+	for _, key := range []string{"index.html", "docs/index.html"} {
+		if _, ok := entryPoints[key]; !ok {
+			t.Errorf("Missing entry point %s", key)
+		}
+	}
+
+	assets, entryPoints = splitEntryPoints(fileMap, []string{"index.html", "manifest.json"})
+
+	if _, ok := entryPoints["manifest.json"]; !ok || len(entryPoints) != 2 {
+		t.Errorf("Invalid configured entry points: %v", entryPoints)
+	}
+
+	if _, ok := assets["docs/index.html"]; !ok {
+		t.Errorf("Nested page was not treated as an asset: %v", assets)
+	}
+}
@@ -0,0 +1,231 @@
+package s3site
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// extractLimits bound what extracting an untrusted archive may write to disk.
+type extractLimits struct {
+	// Total size of the extracted files in bytes
+	MaxBytes int64
+	// Number of extracted files
+	MaxFiles int
+	// Extracted size relative to the archive size, per archive and per zip entry
+	MaxRatio int
+}
+
+// defaultExtractLimits apply to the limits the resource does not configure.
+var defaultExtractLimits = extractLimits{
+	MaxBytes: 2 << 30,
+	MaxFiles: 100000,
+	MaxRatio: 200,
+}
+
+func siteExtractLimits(d resourceGetter) extractLimits {
+	limits := defaultExtractLimits
+	if v := d.Get("max_extracted_bytes").(int); v > 0 {
+		limits.MaxBytes = int64(v)
+	}
+	if v := d.Get("max_extracted_files").(int); v > 0 {
+		limits.MaxFiles = v
+	}
+	if v := d.Get("max_compression_ratio").(int); v > 0 {
+		limits.MaxRatio = v
+	}
+
+	return limits
+}
+
+// extractor writes archive entries below destination. Every entry name is
+// validated so nothing is written outside of it, links are rejected and the
+// limits are enforced on the bytes actually written, not on the sizes the
+// archive declares.
+type extractor struct {
+	archive     string
+	destination string
+	archiveSize int64
+	limits      extractLimits
+
+	files int
+	bytes int64
+}
+
+func newExtractor(archive string, destination string, limits extractLimits) (*extractor, error) {
+	info, err := os.Stat(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	destination, err = filepath.Abs(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(destination, 0755); err != nil {
+		return nil, err
+	}
+
+	return &extractor{
+		archive:     archive,
+		destination: destination,
+		archiveSize: info.Size(),
+		limits:      limits,
+	}, nil
+}
+
+// target returns the path an entry is extracted to.
+func (e *extractor) target(name string) (string, error) {
+	slashed := strings.Replace(name, "\\", "/", -1)
+	if slashed == "" || strings.HasPrefix(slashed, "/") || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("%s: entry %q has an absolute or invalid path", e.archive, name)
+	}
+
+	for _, segment := range strings.Split(slashed, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("%s: entry %q points outside of the archive", e.archive, name)
+		}
+	}
+
+	target := filepath.Join(e.destination, filepath.FromSlash(slashed))
+	if target != e.destination && !strings.HasPrefix(target, e.destination+string(os.PathSeparator)) {
+		return "", fmt.Errorf("%s: entry %q points outside of the archive", e.archive, name)
+	}
+
+	return target, nil
+}
+
+func (e *extractor) mkdir(name string) error {
+	target, err := e.target(name)
+	if err != nil {
+		return err
+	}
+
+	return os.MkdirAll(target, 0755)
+}
+
+// writeFile extracts a regular file from r.
+func (e *extractor) writeFile(name string, r io.Reader) error {
+	target, err := e.target(name)
+	if err != nil {
+		return err
+	}
+
+	e.files++
+	if e.files > e.limits.MaxFiles {
+		return fmt.Errorf("%s: archive has more than %d files, raise `max_extracted_files` if this is expected",
+			e.archive, e.limits.MaxFiles)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Copy one byte past the tighter limit to find out whether it is exceeded
+	maxRatioBytes := int64(e.limits.MaxRatio) * e.archiveSize
+	remaining := e.limits.MaxBytes - e.bytes
+	if ratioRemaining := maxRatioBytes - e.bytes; ratioRemaining < remaining {
+		remaining = ratioRemaining
+	}
+
+	n, err := io.CopyN(file, r, remaining+1)
+	e.bytes += n
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("%s: error extracting %q: %s", e.archive, name, err)
+	}
+
+	if e.bytes > e.limits.MaxBytes {
+		return fmt.Errorf("%s: archive extracts to more than %d bytes, raise `max_extracted_bytes` if this is expected",
+			e.archive, e.limits.MaxBytes)
+	}
+	if e.bytes > maxRatioBytes {
+		return fmt.Errorf("%s: archive extracts to more than %d times its size, raise `max_compression_ratio` if this is expected",
+			e.archive, e.limits.MaxRatio)
+	}
+
+	return nil
+}
+
+func (e *extractor) extractZip() error {
+	reader, err := zip.OpenReader(e.archive)
+	if err != nil {
+		return fmt.Errorf("%s: %s", e.archive, err)
+	}
+	defer reader.Close()
+
+	for _, entry := range reader.File {
+		mode := entry.Mode()
+		switch {
+		case mode.IsDir():
+			if err := e.mkdir(entry.Name); err != nil {
+				return err
+			}
+			continue
+		case mode&os.ModeSymlink != 0:
+			return fmt.Errorf("%s: entry %q is a symbolic link, links are not supported", e.archive, entry.Name)
+		case !mode.IsRegular():
+			return fmt.Errorf("%s: entry %q is not a regular file", e.archive, entry.Name)
+		}
+
+		if entry.CompressedSize64 > 0 && entry.UncompressedSize64/entry.CompressedSize64 > uint64(e.limits.MaxRatio) {
+			return fmt.Errorf("%s: entry %q is compressed more than %d times, raise `max_compression_ratio` if this is expected",
+				e.archive, entry.Name, e.limits.MaxRatio)
+		}
+
+		if err := e.extractZipEntry(entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *extractor) extractZipEntry(entry *zip.File) error {
+	r, err := entry.Open()
+	if err != nil {
+		return fmt.Errorf("%s: error opening %q: %s", e.archive, entry.Name, err)
+	}
+	defer r.Close()
+
+	return e.writeFile(entry.Name, r)
+}
+
+func (e *extractor) extractTar(r io.Reader) error {
+	reader := tar.NewReader(r)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: %s", e.archive, err)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = e.mkdir(header.Name)
+		case tar.TypeReg, tar.TypeRegA:
+			err = e.writeFile(header.Name, reader)
+		case tar.TypeSymlink, tar.TypeLink:
+			err = fmt.Errorf("%s: entry %q is a link, links are not supported", e.archive, header.Name)
+		case tar.TypeXGlobalHeader:
+			log.Printf("[DEBUG] Skipping global header. archive=%s", e.archive)
+		default:
+			err = fmt.Errorf("%s: entry %q is not a regular file", e.archive, header.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package s3site
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testEntry struct {
+	name     string
+	body     string
+	symlink  bool
+	typeflag byte
+}
+
+func writeTestZip(t *testing.T, path string, entries []testEntry) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+		header.SetMode(0644)
+		if entry.symlink {
+			header.SetMode(os.ModeSymlink | 0777)
+		}
+
+		f, err := w.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(entry.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestTar(t *testing.T, path string, entries []testEntry, compress bool) {
+	var buf bytes.Buffer
+	var out io.Writer = &buf
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(&buf)
+		out = gz
+	}
+
+	w := tar.NewWriter(out)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644, Size: int64(len(entry.body)), Typeflag: tar.TypeReg}
+		if entry.typeflag != 0 {
+			header.Typeflag = entry.typeflag
+			header.Size = 0
+			header.Linkname = entry.body
+		}
+
+		if err := w.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Size > 0 {
+			if _, err := w.Write([]byte(entry.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenArchiveRejects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3site-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	zeros := strings.Repeat("\x00", 1<<20)
+	files := []testEntry{{name: "index.html", body: "<html>"}, {name: "app.js", body: "app"}, {name: "app.css", body: "css"}}
+
+	cases := []struct {
+		name    string
+		zip     []testEntry
+		tar     []testEntry
+		limits  extractLimits
+		message string
+	}{
+		{"parent", []testEntry{{name: "../evil.sh", body: "x"}}, nil, defaultExtractLimits, "points outside of the archive"},
+		{"nested parent", []testEntry{{name: "static/../../evil.sh", body: "x"}}, nil, defaultExtractLimits, "points outside of the archive"},
+		{"backslash parent", []testEntry{{name: "..\\evil.sh", body: "x"}}, nil, defaultExtractLimits, "points outside of the archive"},
+		{"absolute", []testEntry{{name: "/etc/evil", body: "x"}}, nil, defaultExtractLimits, "absolute"},
+		{"zip symlink", []testEntry{{name: "link", body: "/etc/passwd", symlink: true}}, nil, defaultExtractLimits, "symbolic link"},
+		{"tar symlink", nil, []testEntry{{name: "link", body: "/etc/passwd", typeflag: tar.TypeSymlink}}, defaultExtractLimits, "is a link"},
+		{"tar hard link", nil, []testEntry{{name: "link", body: "index.html", typeflag: tar.TypeLink}}, defaultExtractLimits, "is a link"},
+		{"tar parent", nil, []testEntry{{name: "../evil.sh", body: "x"}}, defaultExtractLimits, "points outside of the archive"},
+		{"file count", files, nil, extractLimits{MaxBytes: 1 << 20, MaxFiles: 2, MaxRatio: 100}, "max_extracted_files"},
+		{"size", files, nil, extractLimits{MaxBytes: 8, MaxFiles: 10, MaxRatio: 100}, "max_extracted_bytes"},
+		{"zip entry ratio", []testEntry{{name: "bomb", body: zeros}}, nil, defaultExtractLimits, "compressed more than 200 times"},
+		{"tar.gz ratio", nil, []testEntry{{name: "big", body: zeros}}, defaultExtractLimits, "max_compression_ratio"},
+	}
+
+	for _, c := range cases {
+		archive := filepath.Join(dir, strings.Replace(c.name, " ", "-", -1))
+		format := archiveFormatZip
+		if c.tar != nil {
+			format = archiveFormatTarGz
+			writeTestTar(t, archive, c.tar, true)
+		} else {
+			writeTestZip(t, archive, c.zip)
+		}
+
+		destination := filepath.Join(dir, "extracted", strings.Replace(c.name, " ", "-", -1))
+		err := openArchive(archive, format, destination, c.limits)
+		if err == nil || !strings.Contains(err.Error(), c.message) {
+			t.Errorf("Invalid error for %s. expected=%s, actual=%v", c.name, c.message, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "extracted", "evil.sh")); err == nil {
+		t.Error("File was written outside of the destination")
+	}
+}
+
+func TestOpenArchiveWithinLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3site-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := filepath.Join(dir, "site.zip")
+	writeTestZip(t, archive, []testEntry{{name: "static/"}, {name: "static/app.js", body: "app"}, {name: "./index.html", body: "<html>"}})
+
+	destination := filepath.Join(dir, "extracted")
+	if err := openArchive(archive, "", destination, extractLimits{MaxBytes: 9, MaxFiles: 2, MaxRatio: 100}); err != nil {
+		t.Fatalf("Unable to open archive: %s", err)
+	}
+
+	for _, file := range []string{"static/app.js", "index.html"} {
+		if _, err := os.Stat(filepath.Join(destination, filepath.FromSlash(file))); err != nil {
+			t.Errorf("Missing %s: %s", file, err)
+		}
+	}
+}
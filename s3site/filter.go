@@ -0,0 +1,111 @@
+package s3site
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/bmatcuk/doublestar"
+)
+
+// keyFilter decides which object keys are part of a site.
+//
+// A key is kept when include is empty or at least one include pattern matches
+// it. Exclude patterns are then evaluated in order and the last one matching
+// the key wins: a plain pattern drops the key, a pattern starting with `!`
+// keeps it again. All patterns use doublestar glob syntax against the object
+// key relative to the site prefix.
+type keyFilter struct {
+	include []string
+	exclude []string
+}
+
+func newKeyFilter(include []interface{}, exclude []interface{}) keyFilter {
+	return keyFilter{
+		include: expandStringList(include),
+		exclude: expandStringList(exclude),
+	}
+}
+
+func (f keyFilter) match(key string) bool {
+	if len(f.include) > 0 {
+		included := false
+		for _, pattern := range f.include {
+			if globMatch(pattern, key) {
+				included = true
+				break
+			}
+		}
+
+		if !included {
+			return false
+		}
+	}
+
+	keep := true
+	for _, pattern := range f.exclude {
+		negated := strings.HasPrefix(pattern, "!")
+		if globMatch(strings.TrimPrefix(pattern, "!"), key) {
+			keep = negated
+		}
+	}
+
+	return keep
+}
+
+// globMatch reports whether key matches the doublestar pattern. Patterns are
+// validated when the configuration is loaded so errors are not expected here.
+func globMatch(pattern string, key string) bool {
+	matched, err := doublestar.Match(pattern, key)
+	if err != nil {
+		log.Printf("[WARN] Invalid pattern. pattern=%s, err=%s", pattern, err)
+		return false
+	}
+
+	return matched
+}
+
+func validateGlob(v interface{}, k string) (ws []string, errors []error) {
+	pattern := strings.TrimPrefix(v.(string), "!")
+	if pattern == "" {
+		errors = append(errors, fmt.Errorf("%q must not be empty", k))
+		return
+	}
+
+	if err := checkGlob(pattern); err != nil {
+		errors = append(errors, fmt.Errorf("%q contains an invalid pattern %q: %s", k, v, err))
+	}
+
+	return
+}
+
+// checkGlob reports syntax errors anywhere in a doublestar pattern. Matching
+// stops at the first mismatch, so errors in the rest of a pattern would
+// otherwise only show up for some keys.
+func checkGlob(pattern string) error {
+	if strings.Count(pattern, "{") != strings.Count(pattern, "}") {
+		return doublestar.ErrBadPattern
+	}
+
+	// Alternatives are checked as plain characters, path.Match validates the rest
+	stripped := strings.NewReplacer("{", "", "}", "").Replace(pattern)
+	for _, segment := range strings.Split(stripped, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func expandStringList(list []interface{}) []string {
+	result := make([]string, 0, len(list))
+	for _, v := range list {
+		if s, ok := v.(string); ok && s != "" {
+			result = append(result, s)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,68 @@
+package s3site
+
+import (
+	"testing"
+)
+
+func TestKeyFilter(t *testing.T) {
+	cases := []struct {
+		name     string
+		include  []interface{}
+		exclude  []interface{}
+		key      string
+		expected bool
+	}{
+		{"no patterns", nil, nil, "index.html", true},
+		{"exclude at root", nil, []interface{}{"**/*.map"}, "app.js.map", false},
+		{"exclude nested", nil, []interface{}{"**/*.map"}, "static/js/app.js.map", false},
+		{"exclude other extension", nil, []interface{}{"**/*.map"}, "static/js/app.js", true},
+		{"negated exclude", nil, []interface{}{"**/*.map", "!vendor/*.map"}, "vendor/lib.js.map", true},
+		{"negated exclude keeps", nil, []interface{}{"**/*.map", "!vendor/*.map"}, "vendor/lib.map", true},
+		{"negated exclude is not recursive", nil, []interface{}{"**/*.map", "!vendor/*.map"}, "vendor/sub/lib.map", false},
+		{"last match wins", nil, []interface{}{"!vendor/*.map", "**/*.map"}, "vendor/lib.map", false},
+		{"single star does not cross directories", nil, []interface{}{"*.map"}, "static/app.map", true},
+		{"include only", []interface{}{"static/**"}, nil, "static/css/site.css", true},
+		{"include misses", []interface{}{"static/**"}, nil, "index.html", false},
+		{"include then exclude", []interface{}{"static/**"}, []interface{}{"**/*.map"}, "static/app.map", false},
+		{"keys with percent signs", nil, []interface{}{"**/*%%*"}, "a%%b.txt", false},
+	}
+
+	for _, c := range cases {
+		filter := newKeyFilter(c.include, c.exclude)
+		if actual := filter.match(c.key); actual != c.expected {
+			t.Errorf("%s: invalid match for %s. expected=%t, actual=%t", c.name, c.key, c.expected, actual)
+		}
+	}
+}
+
+func TestFilterObjects(t *testing.T) {
+	objects := map[string]siteObject{
+		"index.html":     {Key: "index.html"},
+		"static/app.js":  {Key: "static/app.js"},
+		"static/app.map": {Key: "static/app.map"},
+	}
+
+	filtered := filterObjects(objects, newKeyFilter(nil, []interface{}{"**/*.map"}))
+
+	if len(filtered) != 2 {
+		t.Errorf("Invalid filtered objects: %v", filtered)
+	}
+
+	if _, ok := filtered["static/app.map"]; ok {
+		t.Error("Excluded key was not filtered out")
+	}
+}
+
+func TestValidateGlob(t *testing.T) {
+	for _, pattern := range []string{"**/*.map", "!vendor/*.map", "static/{js,css}/**"} {
+		if _, errors := validateGlob(pattern, "exclude"); len(errors) > 0 {
+			t.Errorf("Unexpected error for %s: %v", pattern, errors)
+		}
+	}
+
+	for _, pattern := range []string{"", "!", "static/[", "!**/[a-"} {
+		if _, errors := validateGlob(pattern, "exclude"); len(errors) == 0 {
+			t.Errorf("Expected an error for %q", pattern)
+		}
+	}
+}
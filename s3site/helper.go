@@ -2,38 +2,29 @@ package s3site
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	"github.com/mholt/archiver"
+	"github.com/hashicorp/go-multierror"
 )
 
-var tempDir string = "/tmp/s3site"
-
-func cleanTmp() error {
-	return os.RemoveAll(tempDir)
-}
-
-func prepareTmp() error {
-	if _, err := os.Stat(tempDir); os.IsNotExist(err) {
-		return os.Mkdir(tempDir, 0755)
-	}
-
-	return nil
-}
-
 type S3Helper struct {
 	session  *session.Session
 	uploader *s3manager.Uploader
@@ -79,72 +70,435 @@ func (s3Helper S3Helper) GetObject(bucket string, key string, localPath string)
 	return nil
 }
 
-func (s3Helper S3Helper) ListS3Objects(bucket string) (*s3.ListObjectsV2Output, error) {
+// GetObjectBytes returns the content of a small object, or nil when the key
+// does not exist.
+func (s3Helper S3Helper) GetObjectBytes(bucket string, key string) ([]byte, error) {
 	s3conn := s3.New(s3Helper.session)
 
-	input := &s3.ListObjectsV2Input{
+	result, err := s3conn.GetObject(&s3.GetObjectInput{
 		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if isAWSErr(err, s3.ErrCodeNoSuchKey, "") {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading s3://%s/%s: %s", bucket, key, err)
+	}
+	defer result.Body.Close()
+
+	body, err := ioutil.ReadAll(result.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading s3://%s/%s: %s", bucket, key, err)
 	}
 
-	return s3conn.ListObjectsV2(input)
+	return body, nil
 }
 
-func (s3Helper S3Helper) DeleteAllObjects(bucket string) error {
-	listObjectResponse, err := s3Helper.ListS3Objects(bucket)
+// PutObjectBytes writes a small object in a single request.
+func (s3Helper S3Helper) PutObjectBytes(bucket string, key string, body []byte, contentType string) error {
+	s3conn := s3.New(s3Helper.session)
+
+	_, err := s3conn.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return fmt.Errorf("error writing s3://%s/%s: %s", bucket, key, err)
+	}
+
+	return nil
+}
+
+// WalkS3Objects calls fn for every object below prefix, one listing page at
+// a time, following continuation tokens until the listing is exhausted.
+func (s3Helper S3Helper) WalkS3Objects(bucket string, prefix string, fn func(objects []*s3.Object) error) error {
+	return walkS3Objects(s3.New(s3Helper.session), bucket, prefix, fn)
+}
+
+func walkS3Objects(s3conn s3iface.S3API, bucket string, prefix string, fn func(objects []*s3.Object) error) error {
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(bucket),
+		MaxKeys: aws.Int64(1000),
+	}
+
+	if prefix = normalizePrefix(prefix); prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+
+	var fnErr error
+	pages := 0
+	err := s3conn.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		pages++
+		log.Printf("[DEBUG] Listed page of objects. bucket=%s, prefix=%s, page=%d, keys=%d", bucket, prefix, pages, len(page.Contents))
+
+		if len(page.Contents) == 0 {
+			return true
+		}
+
+		if fnErr = fn(page.Contents); fnErr != nil {
+			return false
+		}
+
+		return true
+	})
 
 	if err != nil {
 		return err
 	}
 
-	var keys []string
-	for _, object := range listObjectResponse.Contents {
-		keys = append(keys, *object.Key)
+	return fnErr
+}
+
+// HeadS3Objects fetches the headers of keys with a pool of parallelism
+// workers and hands each result to fn. Calls to fn are serialized. Keys that
+// disappeared since they were listed are skipped.
+func (s3Helper S3Helper) HeadS3Objects(bucket string, keys []string, parallelism int, fn func(key string, head *s3.HeadObjectOutput)) error {
+	s3conn := s3.New(s3Helper.session)
+
+	var mutex sync.Mutex
+	return forEachKey(context.Background(), keys, parallelism, func(ctx context.Context, key string) error {
+		head, err := s3conn.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if isAWSErr(err, "NotFound", "") {
+			log.Printf("[DEBUG] Object disappeared while reading. bucket=%s, key=%s", bucket, key)
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error reading s3://%s/%s: %w", bucket, key, err)
+		}
+
+		mutex.Lock()
+		fn(key, head)
+		mutex.Unlock()
+
+		return nil
+	})
+}
+
+// GetS3ObjectTags fetches the tags of keys with a pool of parallelism workers
+// and hands each result to fn. Calls to fn are serialized. Keys that
+// disappeared since they were listed are skipped.
+func (s3Helper S3Helper) GetS3ObjectTags(bucket string, keys []string, parallelism int, fn func(key string, tags map[string]string)) error {
+	s3conn := s3.New(s3Helper.session)
+
+	var mutex sync.Mutex
+	return forEachKey(context.Background(), keys, parallelism, func(ctx context.Context, key string) error {
+		output, err := s3conn.GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if isAWSErr(err, s3.ErrCodeNoSuchKey, "") {
+			log.Printf("[DEBUG] Object disappeared while reading. bucket=%s, key=%s", bucket, key)
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error reading tags of s3://%s/%s: %w", bucket, key, err)
+		}
+
+		tags := make(map[string]string)
+		for _, tag := range output.TagSet {
+			tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+
+		mutex.Lock()
+		fn(key, tags)
+		mutex.Unlock()
+
+		return nil
+	})
+}
+
+// PutS3ObjectTags replaces the tags of the uploaded files with their
+// configured ones, removing all tags from files that have none.
+func (s3Helper S3Helper) PutS3ObjectTags(ctx context.Context, fileMap map[string]fileInfo, bucket string, prefix string, parallelism int) error {
+	s3conn := s3.New(s3Helper.session)
+
+	files := make(map[string]fileInfo)
+	keys := make([]string, 0, len(fileMap))
+	for _, fi := range fileMap {
+		key := objectKey(prefix, fi.RelativePath)
+		files[key] = fi
+		keys = append(keys, key)
 	}
 
-	return s3Helper.DeleteObjects(bucket, keys)
+	log.Printf("[INFO] Updating tags. bucket=%s, prefix=%s, files=%d, parallelism=%d", bucket, prefix, len(keys), parallelism)
+
+	return forEachKey(ctx, keys, parallelism, func(ctx context.Context, key string) error {
+		tagSet := make([]*s3.Tag, 0, len(files[key].Tags))
+		for name, value := range files[key].Tags {
+			tagSet = append(tagSet, &s3.Tag{Key: aws.String(name), Value: aws.String(value)})
+		}
+
+		log.Printf("[DEBUG] Tagging key. bucket=%s, key=%s, tags=%d", bucket, key, len(tagSet))
+		_, err := s3conn.PutObjectTaggingWithContext(ctx, &s3.PutObjectTaggingInput{
+			Bucket:  aws.String(bucket),
+			Key:     aws.String(key),
+			Tagging: &s3.Tagging{TagSet: tagSet},
+		})
+		if err != nil {
+			return fmt.Errorf("error tagging s3://%s/%s: %w", bucket, key, err)
+		}
+
+		return nil
+	})
 }
 
-func (s3Helper S3Helper) BulkUploadS3Objects(fileMap map[string]fileInfo, bucket string) error {
+// CopyS3ObjectVersions copies the recorded version of every object over its
+// current one and returns the new version ids by relative key. Metadata and
+// tags are copied by S3; storage class, ACL and encryption are carried over
+// from the source version explicitly since a copy does not keep them.
+func (s3Helper S3Helper) CopyS3ObjectVersions(ctx context.Context, objects map[string]siteObject, bucket string, prefix string, parallelism int) (map[string]string, error) {
+	s3conn := s3.New(s3Helper.session)
+
+	keys := sortedObjectKeys(objects)
+	versions := make(map[string]string)
+	var mutex sync.Mutex
+
+	err := forEachKey(ctx, keys, parallelism, func(ctx context.Context, key string) error {
+		object := objects[key]
+		s3Key := objectKey(prefix, key)
 
-	for _, fileInfo := range fileMap {
-		fileData, err := ioutil.ReadFile(fileInfo.FullPath)
+		head, err := s3conn.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket:    aws.String(bucket),
+			Key:       aws.String(s3Key),
+			VersionId: aws.String(object.VersionId),
+		})
 		if err != nil {
-			return err
+			return fmt.Errorf("error reading s3://%s/%s version %s: %w", bucket, s3Key, object.VersionId, err)
 		}
 
-		reader := bytes.NewReader(fileData)
+		source := (&url.URL{Path: bucket + "/" + s3Key}).EscapedPath() + "?versionId=" + url.QueryEscape(object.VersionId)
+		input := &s3.CopyObjectInput{
+			Bucket:               aws.String(bucket),
+			Key:                  aws.String(s3Key),
+			CopySource:           aws.String(source),
+			StorageClass:         head.StorageClass,
+			ServerSideEncryption: head.ServerSideEncryption,
+			SSEKMSKeyId:          head.SSEKMSKeyId,
+		}
 
-		uploadInput := &s3manager.UploadInput{
-			Bucket:      &bucket,
-			Key:         &fileInfo.RelativePath,
-			Body:        reader,
-			ContentType: &fileInfo.ContentType,
+		if acl := headMetadata(head, metadataACL); acl != "" {
+			input.ACL = aws.String(acl)
 		}
 
-		if fileInfo.ContentEncoding != "" {
-			uploadInput.ContentEncoding = &fileInfo.ContentEncoding
+		var requestOptions []request.Option
+		if strings.HasSuffix(headMetadata(head, metadataEncryption), ":bucket-key") {
+			requestOptions = append(requestOptions, setUploadHeader("X-Amz-Server-Side-Encryption-Bucket-Key-Enabled", "true"))
 		}
 
-		if fileInfo.CacheControl != "" {
-			uploadInput.CacheControl = &fileInfo.CacheControl
+		log.Printf("[DEBUG] Restoring key. bucket=%s, key=%s, version=%s", bucket, s3Key, object.VersionId)
+		output, err := s3conn.CopyObjectWithContext(ctx, input, requestOptions...)
+		if err != nil {
+			return fmt.Errorf("error restoring s3://%s/%s version %s: %w", bucket, s3Key, object.VersionId, err)
 		}
 
-		if fileInfo.Expires != "" {
-			secs, err2 := strconv.ParseInt(fileInfo.Expires, 10, 64)
-			if err2 != nil {
-				log.Fatal("invalid value for Expires " + fileInfo.Expires)
+		mutex.Lock()
+		versions[key] = aws.StringValue(output.VersionId)
+		mutex.Unlock()
+
+		return nil
+	})
+
+	return versions, err
+}
+
+// forEachKey calls fn for every key with a pool of parallelism workers. The
+// first failure, or cancelling parent, cancels the calls still in flight;
+// every error that occurred is returned together, except the ones of calls
+// that were cancelled.
+func forEachKey(parent context.Context, keys []string, parallelism int, fn func(ctx context.Context, key string) error) error {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var errors error
+
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for key := range jobs {
+				err := fn(ctx, key)
+				if err == nil || (ctx.Err() != nil && isCanceledErr(err)) {
+					continue
+				}
+
+				mutex.Lock()
+				errors = multierror.Append(errors, err)
+				mutex.Unlock()
+				cancel()
+			}
+		}()
+	}
+
+feed:
+	for _, key := range keys {
+		select {
+		case jobs <- key:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+
+	wg.Wait()
+
+	// Calls aborted by the parent are not reported, its reason is
+	if parent.Err() != nil {
+		errors = multierror.Append(errors, context.Cause(parent))
+	}
+
+	return errors
+}
+
+// DeleteAllObjects deletes every object below prefix except the keys in keep.
+func (s3Helper S3Helper) DeleteAllObjects(bucket string, prefix string, keep ...string) error {
+	keepKeys := make(map[string]bool)
+	for _, key := range keep {
+		keepKeys[key] = true
+	}
+
+	// Delete page by page so the whole listing never has to be held in memory
+	return s3Helper.WalkS3Objects(bucket, prefix, func(page []*s3.Object) error {
+		keys := make([]string, 0, len(page))
+		for _, object := range page {
+			if !keepKeys[*object.Key] {
+				keys = append(keys, *object.Key)
 			}
-			t := time.Unix(time.Now().Unix(), secs)
-			uploadInput.Expires = &t
 		}
 
-		_, uploaderErr := s3Helper.uploader.Upload(uploadInput)
-		if uploaderErr != nil {
-			return uploaderErr
+		_, err := s3Helper.DeleteObjects(bucket, keys)
+		return err
+	})
+}
+
+// BulkUploadS3Objects uploads the files with a pool of parallelism workers and
+// returns the version ids of the uploaded objects by relative path.
+func (s3Helper S3Helper) BulkUploadS3Objects(ctx context.Context, fileMap map[string]fileInfo, bucket string, prefix string, parallelism int) (map[string]string, error) {
+	keys := make([]string, 0, len(fileMap))
+	for key := range fileMap {
+		keys = append(keys, key)
+	}
+
+	log.Printf("[INFO] Uploading files. bucket=%s, prefix=%s, files=%d, parallelism=%d", bucket, prefix, len(fileMap), parallelism)
+
+	versions := make(map[string]string)
+	var mutex sync.Mutex
+	err := forEachKey(ctx, keys, parallelism, func(ctx context.Context, key string) error {
+		fi := fileMap[key]
+		versionId, err := s3Helper.uploadFile(ctx, fi, bucket, prefix)
+		if err != nil {
+			return err
 		}
+
+		mutex.Lock()
+		versions[fi.RelativePath] = versionId
+		mutex.Unlock()
+
+		return nil
+	})
+
+	return versions, err
+}
+
+// uploadFile uploads a single file and returns the version id of the object,
+// empty when the bucket is not versioned.
+func (s3Helper S3Helper) uploadFile(ctx context.Context, fileInfo fileInfo, bucket string, prefix string) (string, error) {
+	fileData, err := ioutil.ReadFile(fileInfo.FullPath)
+	if err != nil {
+		return "", err
 	}
 
-	return nil
+	reader := bytes.NewReader(fileData)
+	key := objectKey(prefix, fileInfo.RelativePath)
+
+	uploadInput := &s3manager.UploadInput{
+		Bucket:      &bucket,
+		Key:         &key,
+		Body:        reader,
+		ContentType: &fileInfo.ContentType,
+	}
+
+	if fileInfo.ContentEncoding != "" {
+		uploadInput.ContentEncoding = &fileInfo.ContentEncoding
+	}
+
+	if fileInfo.CacheControl != "" {
+		uploadInput.CacheControl = &fileInfo.CacheControl
+	}
+
+	if fileInfo.ContentDisposition != "" {
+		uploadInput.ContentDisposition = &fileInfo.ContentDisposition
+	}
+
+	if fileInfo.ContentLanguage != "" {
+		uploadInput.ContentLanguage = &fileInfo.ContentLanguage
+	}
+
+	uploadInput.Metadata = aws.StringMap(fileInfo.uploadMetadata())
+
+	if fileInfo.ACL != "" {
+		uploadInput.ACL = aws.String(fileInfo.ACL)
+	}
+
+	if fileInfo.StorageClass != "" {
+		uploadInput.StorageClass = aws.String(fileInfo.StorageClass)
+	}
+
+	if len(fileInfo.Tags) > 0 {
+		uploadInput.Tagging = aws.String(fileInfo.uploadTagging())
+	}
+
+	var requestOptions []request.Option
+	if fileInfo.ServerSideEncryption != "" {
+		uploadInput.ServerSideEncryption = aws.String(fileInfo.ServerSideEncryption)
+
+		if fileInfo.SSEKMSKeyId != "" {
+			uploadInput.SSEKMSKeyId = aws.String(fileInfo.SSEKMSKeyId)
+		}
+
+		if fileInfo.BucketKeyEnabled {
+			requestOptions = append(requestOptions, setUploadHeader("X-Amz-Server-Side-Encryption-Bucket-Key-Enabled", "true"))
+		}
+	}
+
+	if fileInfo.Expires != "" {
+		secs, err := strconv.ParseInt(fileInfo.Expires, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid value for Expires %s on %s", fileInfo.Expires, key)
+		}
+		t := time.Unix(time.Now().Unix()+secs, 0)
+		uploadInput.Expires = &t
+	}
+
+	log.Printf("[DEBUG] Uploading key. bucket=%s, key=%s", bucket, key)
+	output, err := s3Helper.uploader.UploadWithContext(ctx, uploadInput, s3manager.WithUploaderRequestOptions(requestOptions...))
+	if err != nil {
+		return "", fmt.Errorf("error uploading s3://%s/%s: %w", bucket, key, err)
+	}
+
+	return aws.StringValue(output.VersionID), nil
+}
+
+// setUploadHeader sets a header the SDK has no field for on the requests that
+// create or delete an object. Multipart part uploads reject object level
+// headers.
+func setUploadHeader(name string, value string) request.Option {
+	return func(r *request.Request) {
+		switch r.Operation.Name {
+		case "PutObject", "CreateMultipartUpload", "CopyObject", "DeleteObject":
+			r.HTTPRequest.Header.Set(name, value)
+		}
+	}
 }
 
 func (s3Helper S3Helper) PutFile(fi fileInfo, bucket string) error {
@@ -174,38 +528,81 @@ func (s3Helper S3Helper) PutFile(fi fileInfo, bucket string) error {
 	return nil
 }
 
-func (s3Helper S3Helper) DeleteObjects(bucket string, keys []string) error {
-	svc := s3.New(s3Helper.session)
+// Maximum number of keys accepted by a single DeleteObjects request
+const deleteBatchSize = 1000
 
-	for _, key := range keys {
-		log.Printf("[DEBUG] Deleting key. bucket=%s, key=%s", bucket, key)
-		_, err := svc.DeleteObject(&s3.DeleteObjectInput{
-			Bucket: &bucket,
-			Key:    &key,
-		})
+// DeleteObjects removes keys in batches through the multi-object delete API.
+// Every batch is attempted even when an earlier one fails; the keys that were
+// removed are returned alongside all of the collected per-key errors.
+func (s3Helper S3Helper) DeleteObjects(bucket string, keys []string) ([]string, error) {
+	return deleteObjects(s3.New(s3Helper.session), bucket, keys)
+}
+
+func deleteObjects(s3conn s3iface.S3API, bucket string, keys []string) ([]string, error) {
+	var deleted []string
+	var errors error
+	for start := 0; start < len(keys); start += deleteBatchSize {
+		end := start + deleteBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		batch := keys[start:end]
+
+		objects := make([]*s3.ObjectIdentifier, 0, len(batch))
+		for _, key := range batch {
+			log.Printf("[DEBUG] Deleting key. bucket=%s, key=%s", bucket, key)
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
 
+		output, err := s3conn.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &s3.Delete{
+				Objects: objects,
+				Quiet:   aws.Bool(true),
+			},
+		})
 		if err != nil {
-			return err
+			errors = multierror.Append(errors, fmt.Errorf("error deleting %d keys from %s: %s", len(batch), bucket, err))
+			continue
+		}
+
+		failed := make(map[string]bool)
+		for _, deleteErr := range output.Errors {
+			key := aws.StringValue(deleteErr.Key)
+			failed[key] = true
+			errors = multierror.Append(errors, fmt.Errorf("error deleting s3://%s/%s: %s: %s",
+				bucket, key, aws.StringValue(deleteErr.Code), aws.StringValue(deleteErr.Message)))
+		}
+
+		for _, key := range batch {
+			if !failed[key] {
+				deleted = append(deleted, key)
+			}
 		}
 	}
 
-	return nil
+	return deleted, errors
 }
 
 func cleanS3ETag(eTag string) string {
 	return strings.Trim(eTag, "\\\"")
 }
 
-func extractArchive(archive string) ([]fileInfo, error) {
-	log.Printf("[DEBUG] Extracting archive. path=%s", archive)
+// listDirectory walks a directory tree and returns every regular file in it,
+// with the relative path using forward slashes so it can be used as a key.
+// Links and other special files are rejected, as they are in archives, so
+// nothing outside the tree is deployed.
+func listDirectory(dir string) ([]fileInfo, error) {
+	log.Printf("[DEBUG] Listing directory. path=%s", dir)
 
-	extractedDir := fmt.Sprintf("%s/site/", tempDir)
-	if err := archiver.Zip.Open(archive, extractedDir); err != nil {
+	// The directory itself may be a link, only links inside it are rejected
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
 		return nil, err
 	}
 
 	var fileList []fileInfo
-	if err := filepath.Walk(extractedDir, func(path string, info os.FileInfo, err error) error {
+	if err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -214,9 +611,21 @@ func extractArchive(archive string) ([]fileInfo, error) {
 			return nil
 		}
 
+		relativePath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		switch mode := info.Mode(); {
+		case mode&os.ModeSymlink != 0:
+			return fmt.Errorf("%s: %q is a symbolic link, links are not supported", dir, filepath.ToSlash(relativePath))
+		case !mode.IsRegular():
+			return fmt.Errorf("%s: %q is not a regular file", dir, filepath.ToSlash(relativePath))
+		}
+
 		fileList = append(fileList, fileInfo{
 			FullPath:     path,
-			RelativePath: strings.TrimPrefix(path, extractedDir),
+			RelativePath: filepath.ToSlash(relativePath),
 			FileInfo:     info,
 		})
 
@@ -229,14 +638,25 @@ func extractArchive(archive string) ([]fileInfo, error) {
 }
 
 type fileInfo struct {
-	FullPath        string
-	RelativePath    string
-	FileInfo        os.FileInfo
-	ContentType     string
-	ContentEncoding string
-	Hash            string
-	CacheControl    string
-	Expires         string
+	FullPath           string
+	RelativePath       string
+	FileInfo           os.FileInfo
+	ContentType        string
+	ContentEncoding    string
+	ContentDisposition string
+	ContentLanguage    string
+	Hash               string
+	CacheControl       string
+	Expires            string
+	Metadata           map[string]string
+
+	ServerSideEncryption string
+	SSEKMSKeyId          string
+	BucketKeyEnabled     bool
+	ChecksumAlgorithm    string
+	ACL                  string
+	StorageClass         string
+	Tags                 map[string]string
 }
 
 func (f fileInfo) getMd5Checksum() (string, error) {
@@ -272,10 +692,50 @@ func (f fileInfo) getMd5Checksum() (string, error) {
 	return etag, nil
 }
 
+// normalizePrefix turns a user supplied key prefix into the form used on S3
+// keys: no leading slash and exactly one trailing slash, or empty.
+func normalizePrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+
+	return prefix + "/"
+}
+
+// objectKey returns the S3 key of a site file relative to the site prefix.
+func objectKey(prefix string, relativePath string) string {
+	return normalizePrefix(prefix) + relativePath
+}
+
+// siteId builds the resource ID of a site, either `bucket` or `bucket/prefix`.
+func siteId(bucket string, prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return bucket
+	}
+
+	return fmt.Sprintf("%s/%s", bucket, prefix)
+}
+
+// parseSiteId splits a resource ID built by siteId into bucket and prefix.
+func parseSiteId(id string) (string, string) {
+	parts := strings.SplitN(id, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+
+	return parts[0], strings.Trim(parts[1], "/")
+}
+
+// encodeKey replaces every `.` of an object key with `%%` for the legacy
+// `files` map.
 func encodeKey(key string) string {
 	return strings.Replace(key, ".", "%%", -1)
 }
 
+// decodeKey restores the object key of a legacy `files` map entry, which
+// stored keys with every `.` replaced by `%%`.
 func decodeKey(key string) string {
 	return strings.Replace(key, "%%", ".", -1)
 }
@@ -0,0 +1,320 @@
+package s3site
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/hashicorp/go-multierror"
+)
+
+func TestObjectKey(t *testing.T) {
+	cases := map[string]string{
+		"":            "index.html",
+		"/":           "index.html",
+		"app":         "app/index.html",
+		"app/":        "app/index.html",
+		"/preview/1/": "preview/1/index.html",
+	}
+
+	for prefix, expected := range cases {
+		if key := objectKey(prefix, "index.html"); key != expected {
+			t.Errorf("Invalid key for prefix %q. expected=%s, actual=%s", prefix, expected, key)
+		}
+	}
+}
+
+func TestSiteId(t *testing.T) {
+	if id := siteId("bucket", ""); id != "bucket" {
+		t.Errorf("Invalid id without prefix: %s", id)
+	}
+
+	if id := siteId("bucket", "/preview/1/"); id != "bucket/preview/1" {
+		t.Errorf("Invalid id with prefix: %s", id)
+	}
+
+	bucket, prefix := parseSiteId("bucket")
+	if bucket != "bucket" || prefix != "" {
+		t.Errorf("Invalid parse of id without prefix. bucket=%s, prefix=%s", bucket, prefix)
+	}
+
+	bucket, prefix = parseSiteId("bucket/preview/1")
+	if bucket != "bucket" || prefix != "preview/1" {
+		t.Errorf("Invalid parse of id with prefix. bucket=%s, prefix=%s", bucket, prefix)
+	}
+}
+
+func TestListDirectory(t *testing.T) {
+	files, err := listDirectory("../test_resources")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make(map[string]bool)
+	for _, f := range files {
+		keys[f.RelativePath] = true
+	}
+
+	for _, expected := range []string{"index.html", "index.js", "index_compressed.js", "logo.svg"} {
+		if !keys[expected] {
+			t.Errorf("Missing %s in directory listing: %v", expected, keys)
+		}
+	}
+}
+
+func TestListDirectoryRejectsLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3site-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("<html></html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"index.html", "."} {
+		link := filepath.Join(dir, "link")
+		os.Remove(link)
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := listDirectory(dir); err == nil || !strings.Contains(err.Error(), `"link" is a symbolic link`) {
+			t.Errorf("Invalid error for a link to %q: %v", target, err)
+		}
+	}
+}
+
+func TestListDirectoryLinkedRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3site-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "build", "out")
+	if err := os.MkdirAll(out, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(out, "index.html"), []byte("<html></html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dist := filepath.Join(dir, "dist")
+	if err := os.Symlink(filepath.Join("build", "out"), dist); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := listDirectory(dist)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 || files[0].RelativePath != "index.html" {
+		t.Errorf("Invalid listing of a linked directory: %+v", files)
+	}
+}
+
+func TestForEachKeyCancel(t *testing.T) {
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+
+	// The first failure stops the keys not started yet
+	var mutex sync.Mutex
+	var called []string
+	err := forEachKey(context.Background(), keys, 1, func(ctx context.Context, key string) error {
+		mutex.Lock()
+		called = append(called, key)
+		mutex.Unlock()
+
+		if key == "b" {
+			return fmt.Errorf("failed %s", key)
+		}
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "failed b") {
+		t.Errorf("Invalid error: %v", err)
+	}
+	if len(called) > 3 {
+		t.Errorf("Keys were processed after the failure: %v", called)
+	}
+
+	// A cancelled parent is reported with its cause
+	parent, cancel := context.WithCancelCause(context.Background())
+	err = forEachKey(parent, keys, 2, func(ctx context.Context, key string) error {
+		if key == "a" {
+			cancel(fmt.Errorf("lease lost"))
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err == nil || !strings.Contains(err.Error(), "lease lost") {
+		t.Errorf("Invalid error for a cancelled parent: %v", err)
+	}
+}
+
+func TestForEachKeyErrors(t *testing.T) {
+	// Failures of calls running concurrently are all reported, calls
+	// cancelled by the first failure are not
+	var started sync.WaitGroup
+	started.Add(2)
+	err := forEachKey(context.Background(), []string{"a", "b", "c"}, 3, func(ctx context.Context, key string) error {
+		if key == "c" {
+			<-ctx.Done()
+			return fmt.Errorf("error uploading %s: %w", key, awserr.New(request.CanceledErrorCode, "request context canceled", ctx.Err()))
+		}
+
+		started.Done()
+		started.Wait()
+		return fmt.Errorf("error uploading %s: AccessDenied", key)
+	})
+
+	merr, ok := err.(*multierror.Error)
+	if !ok || len(merr.Errors) != 2 {
+		t.Fatalf("Invalid errors: %v", err)
+	}
+	if strings.Contains(err.Error(), "uploading c") {
+		t.Errorf("Cancelled call was reported: %v", err)
+	}
+}
+
+// fakeDeleteS3 records the batches of multi-object deletes and reports the
+// keys in fail as failed.
+type fakeDeleteS3 struct {
+	s3iface.S3API
+
+	batches []int
+	fail    map[string]bool
+}
+
+func (f *fakeDeleteS3) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	f.batches = append(f.batches, len(input.Delete.Objects))
+
+	output := &s3.DeleteObjectsOutput{}
+	for _, object := range input.Delete.Objects {
+		if f.fail[aws.StringValue(object.Key)] {
+			output.Errors = append(output.Errors, &s3.Error{
+				Key:     object.Key,
+				Code:    aws.String("AccessDenied"),
+				Message: aws.String("Access Denied"),
+			})
+		}
+	}
+
+	return output, nil
+}
+
+func TestDeleteObjects(t *testing.T) {
+	keys := make([]string, 1001)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%04d", i)
+	}
+
+	fake := &fakeDeleteS3{fail: map[string]bool{"key-0010": true, "key-1000": true}}
+	deleted, err := deleteObjects(fake, "bucket", keys)
+
+	if len(fake.batches) != 2 || fake.batches[0] != 1000 || fake.batches[1] != 1 {
+		t.Errorf("Invalid batches: %v", fake.batches)
+	}
+
+	if err == nil || !strings.Contains(err.Error(), "s3://bucket/key-0010") || !strings.Contains(err.Error(), "s3://bucket/key-1000") {
+		t.Errorf("Invalid error: %v", err)
+	}
+
+	if len(deleted) != 999 {
+		t.Errorf("Invalid number of deleted keys: %d", len(deleted))
+	}
+	for _, key := range deleted {
+		if fake.fail[key] {
+			t.Errorf("Failed key reported as deleted: %s", key)
+		}
+	}
+
+	fake = &fakeDeleteS3{}
+	if deleted, err := deleteObjects(fake, "bucket", nil); err != nil || len(deleted) != 0 || len(fake.batches) != 0 {
+		t.Errorf("Invalid delete without keys. deleted=%v, err=%v, batches=%v", deleted, err, fake.batches)
+	}
+}
+
+// fakeListS3 serves keys in pages of MaxKeys and records the listing inputs.
+type fakeListS3 struct {
+	s3iface.S3API
+
+	keys   []string
+	inputs []*s3.ListObjectsV2Input
+	pages  int
+}
+
+func (f *fakeListS3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	f.inputs = append(f.inputs, input)
+
+	size := int(aws.Int64Value(input.MaxKeys))
+	for start := 0; start < len(f.keys); start += size {
+		end := start + size
+		if end > len(f.keys) {
+			end = len(f.keys)
+		}
+
+		page := &s3.ListObjectsV2Output{}
+		for _, key := range f.keys[start:end] {
+			page.Contents = append(page.Contents, &s3.Object{Key: aws.String(key)})
+		}
+
+		f.pages++
+		if !fn(page, end == len(f.keys)) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func TestWalkS3Objects(t *testing.T) {
+	keys := make([]string, 2500)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("app/key-%04d", i)
+	}
+
+	fake := &fakeListS3{keys: keys}
+	var walked []string
+	err := walkS3Objects(fake, "bucket", "/app/", func(page []*s3.Object) error {
+		for _, object := range page {
+			walked = append(walked, aws.StringValue(object.Key))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(walked) != len(keys) || fake.pages != 3 {
+		t.Errorf("Not every page was walked. keys=%d, pages=%d", len(walked), fake.pages)
+	}
+	if len(fake.inputs) != 1 || aws.StringValue(fake.inputs[0].Prefix) != "app/" || aws.StringValue(fake.inputs[0].Bucket) != "bucket" {
+		t.Errorf("Invalid listing input: %v", fake.inputs)
+	}
+
+	// An error of fn stops the walk
+	fake = &fakeListS3{keys: keys}
+	calls := 0
+	err = walkS3Objects(fake, "bucket", "", func(page []*s3.Object) error {
+		calls++
+		return fmt.Errorf("stop")
+	})
+	if err == nil || err.Error() != "stop" || calls != 1 || fake.pages != 1 {
+		t.Errorf("Walk did not stop on error. err=%v, calls=%d, pages=%d", err, calls, fake.pages)
+	}
+	if fake.inputs[0].Prefix != nil {
+		t.Errorf("Prefix set for a site without prefix: %s", aws.StringValue(fake.inputs[0].Prefix))
+	}
+}
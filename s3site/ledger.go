@@ -0,0 +1,270 @@
+package s3site
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// Keys below controlDir hold the provider's own bookkeeping. They are never
+// part of the site.
+const controlDir = ".s3site/"
+
+// The ledger records the removed objects that are retained for a while
+const ledgerKey = controlDir + "ledger.json"
+
+// isControlKey reports whether key, relative to the site prefix, is reserved
+// for the provider, either by this site or by a site below its prefix.
+func isControlKey(key string) bool {
+	return strings.HasPrefix(key, controlDir) || strings.Contains(key, "/"+controlDir)
+}
+
+// nestedSites returns the prefixes, relative to the site prefix, of the other
+// sites sharing the bucket below it. Every deployment records a release in the
+// control directory of its site, so a control directory below the top level
+// marks the root of another site.
+func nestedSites(keys []string) []string {
+	seen := make(map[string]bool)
+	var prefixes []string
+	for _, key := range keys {
+		i := strings.Index(key, "/"+controlDir)
+		if i < 0 {
+			continue
+		}
+
+		prefix := key[:i+1]
+		if !seen[prefix] {
+			seen[prefix] = true
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Strings(prefixes)
+
+	return prefixes
+}
+
+// inNestedSite reports whether key belongs to one of the nested sites.
+func inNestedSite(key string, nested []string) bool {
+	for _, prefix := range nested {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retainedObject is an object that was removed from the site but is kept in
+// the bucket until its retention expires.
+type retainedObject struct {
+	Key       string    `json:"key"`
+	RemovedAt time.Time `json:"removed_at"`
+}
+
+type ledger struct {
+	Removed []retainedObject `json:"removed"`
+}
+
+// retention decides how long removed objects are kept. An object is kept while
+// it was removed less than For ago or by one of the last Releases deployments
+// that removed objects. Without either, removed objects are deleted right away.
+type retention struct {
+	For      time.Duration
+	Releases int
+}
+
+func (r retention) enabled() bool {
+	return r.For > 0 || r.Releases > 0
+}
+
+func siteRetention(d resourceGetter) (retention, error) {
+	var r retention
+	if v := d.Get("retain_removed_for").(string); v != "" {
+		duration, err := time.ParseDuration(v)
+		if err != nil {
+			return r, fmt.Errorf("invalid retain_removed_for %q: %s", v, err)
+		}
+		r.For = duration
+	}
+	r.Releases = d.Get("retain_releases").(int)
+
+	return r, nil
+}
+
+func validateDuration(v interface{}, k string) (ws []string, errors []error) {
+	duration, err := time.ParseDuration(v.(string))
+	if err != nil {
+		errors = append(errors, fmt.Errorf("%q must be a duration like 168h: %s", k, err))
+	} else if duration < 0 {
+		errors = append(errors, fmt.Errorf("%q must not be negative", k))
+	}
+
+	return
+}
+
+// retainObjects adds the keys removed at now to the retained objects and
+// splits the result into the objects to keep and the ones to delete. Objects
+// that are part of the site again are dropped from the ledger.
+func retainObjects(retained []retainedObject, removed []string, objects map[string]siteObject, r retention, now time.Time) ([]retainedObject, []retainedObject) {
+	now = now.UTC().Truncate(time.Second)
+
+	candidates := make(map[string]retainedObject)
+	for _, object := range retained {
+		if _, ok := objects[object.Key]; ok {
+			continue
+		}
+		candidates[object.Key] = object
+	}
+	for _, key := range removed {
+		candidates[key] = retainedObject{Key: key, RemovedAt: now}
+	}
+
+	// Rank the deployments that removed objects, the latest one first
+	var removals []time.Time
+	seen := make(map[time.Time]bool)
+	for _, object := range candidates {
+		if !seen[object.RemovedAt] {
+			seen[object.RemovedAt] = true
+			removals = append(removals, object.RemovedAt)
+		}
+	}
+	sort.Slice(removals, func(i, j int) bool { return removals[i].After(removals[j]) })
+
+	rank := make(map[time.Time]int)
+	for i, removedAt := range removals {
+		rank[removedAt] = i
+	}
+
+	var keep, purge []retainedObject
+	for _, key := range sortedRetainedKeys(candidates) {
+		object := candidates[key]
+		if (r.For > 0 && now.Sub(object.RemovedAt) < r.For) || (r.Releases > 0 && rank[object.RemovedAt] < r.Releases) {
+			keep = append(keep, object)
+		} else {
+			purge = append(purge, object)
+		}
+	}
+
+	return keep, purge
+}
+
+func sortedRetainedKeys(objects map[string]retainedObject) []string {
+	keys := make([]string, 0, len(objects))
+	for key := range objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// readLedger loads the ledger of the site, empty when there is none yet.
+func (s3Helper S3Helper) readLedger(bucket string, prefix string) (ledger, error) {
+	var l ledger
+
+	body, err := s3Helper.GetObjectBytes(bucket, objectKey(prefix, ledgerKey))
+	if err != nil || body == nil {
+		return l, err
+	}
+
+	if err := json.Unmarshal(body, &l); err != nil {
+		return l, fmt.Errorf("error parsing ledger s3://%s/%s: %s", bucket, objectKey(prefix, ledgerKey), err)
+	}
+
+	return l, nil
+}
+
+// writeLedger stores the ledger of the site. An empty ledger is removed
+// instead so sites without retention keep no control objects.
+func (s3Helper S3Helper) writeLedger(bucket string, prefix string, l ledger) error {
+	key := objectKey(prefix, ledgerKey)
+
+	if len(l.Removed) == 0 {
+		log.Printf("[DEBUG] Removing empty ledger. bucket=%s, key=%s", bucket, key)
+		_, err := s3Helper.DeleteObjects(bucket, []string{key})
+		return err
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(l); err != nil {
+		return err
+	}
+
+	log.Printf("[DEBUG] Writing ledger. bucket=%s, key=%s, retained=%d", bucket, key, len(l.Removed))
+	return s3Helper.PutObjectBytes(bucket, key, buf.Bytes(), "application/json")
+}
+
+func retainedSchema() *schema.Schema {
+	return &schema.Schema{
+		Type:        schema.TypeList,
+		Computed:    true,
+		Description: "Removed objects kept in the bucket until their retention expires.",
+		Elem: &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"key": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				"removed_at": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+			},
+		},
+	}
+}
+
+func expandRetainedObjects(v interface{}) []retainedObject {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	objects := make([]retainedObject, 0, len(list))
+	for _, raw := range list {
+		m, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		removedAt, err := time.Parse(time.RFC3339, m["removed_at"].(string))
+		if err != nil {
+			log.Printf("[WARN] Invalid retained object. key=%s, removed_at=%s", m["key"], m["removed_at"])
+			continue
+		}
+
+		objects = append(objects, retainedObject{Key: m["key"].(string), RemovedAt: removedAt})
+	}
+
+	return objects
+}
+
+func flattenRetainedObjects(objects []retainedObject) []interface{} {
+	list := make([]interface{}, 0, len(objects))
+	for _, object := range objects {
+		list = append(list, map[string]interface{}{
+			"key":        object.Key,
+			"removed_at": object.RemovedAt.UTC().Format(time.RFC3339),
+		})
+	}
+
+	return list
+}
+
+// retainedKeys returns the keys of the retained objects.
+func retainedKeys(objects []retainedObject) []string {
+	keys := make([]string, 0, len(objects))
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+
+	return keys
+}
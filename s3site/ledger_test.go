@@ -0,0 +1,114 @@
+package s3site
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetainObjects(t *testing.T) {
+	now := time.Date(2020, 10, 20, 12, 0, 0, 0, time.UTC)
+	lastWeek := now.Add(-7 * 24 * time.Hour)
+	yesterday := now.Add(-24 * time.Hour)
+
+	retained := []retainedObject{
+		{Key: "static/v1.js", RemovedAt: lastWeek},
+		{Key: "static/v2.js", RemovedAt: yesterday},
+		{Key: "static/shared.js", RemovedAt: yesterday},
+	}
+	removed := []string{"static/v3.js"}
+	objects := map[string]siteObject{
+		"index.html":       {Key: "index.html"},
+		"static/shared.js": {Key: "static/shared.js"},
+	}
+
+	cases := []struct {
+		name      string
+		retention retention
+		keep      []string
+	}{
+		{"disabled", retention{}, nil},
+		{"duration", retention{For: 48 * time.Hour}, []string{"static/v2.js", "static/v3.js"}},
+		{"releases", retention{Releases: 1}, []string{"static/v3.js"}},
+		{"both", retention{For: 48 * time.Hour, Releases: 3}, []string{"static/v1.js", "static/v2.js", "static/v3.js"}},
+	}
+
+	for _, c := range cases {
+		keep, purge := retainObjects(retained, removed, objects, c.retention, now)
+
+		keepKeys := retainedKeys(keep)
+		if len(keepKeys) != len(c.keep) {
+			t.Errorf("Invalid retained objects for %s. expected=%v, actual=%v", c.name, c.keep, keepKeys)
+			continue
+		}
+		for i, key := range c.keep {
+			if keepKeys[i] != key {
+				t.Errorf("Invalid retained objects for %s. expected=%v, actual=%v", c.name, c.keep, keepKeys)
+				break
+			}
+		}
+
+		// Objects that are part of the site again are neither retained nor deleted
+		if len(keep)+len(purge) != 3 {
+			t.Errorf("Invalid purged objects for %s: %v", c.name, retainedKeys(purge))
+		}
+	}
+}
+
+func TestRetainedObjectsRoundTrip(t *testing.T) {
+	objects := []retainedObject{
+		{Key: "static/v1.js", RemovedAt: time.Date(2020, 10, 20, 12, 0, 0, 0, time.UTC)},
+	}
+
+	result := expandRetainedObjects(flattenRetainedObjects(objects))
+	if len(result) != 1 || result[0].Key != "static/v1.js" || !result[0].RemovedAt.Equal(objects[0].RemovedAt) {
+		t.Errorf("Invalid round trip: %v", result)
+	}
+}
+
+func TestIsControlKey(t *testing.T) {
+	for _, key := range []string{ledgerKey, lockKey, "preview/.s3site/lock.json", "a/b/.s3site/releases/1.json"} {
+		if !isControlKey(key) {
+			t.Errorf("Key not detected as control key: %s", key)
+		}
+	}
+
+	for _, key := range []string{"index.html", "static/.s3site-notes.txt", "static/s3site/app.js"} {
+		if isControlKey(key) {
+			t.Errorf("Key wrongly detected as control key: %s", key)
+		}
+	}
+}
+
+func TestNestedSites(t *testing.T) {
+	// A root site sharing the bucket with a preview site below it
+	keys := []string{
+		".s3site/ledger.json",
+		".s3site/releases/20200101T000000Z.json",
+		"index.html",
+		"preview-notes.txt",
+		"preview/.s3site/lock.json",
+		"preview/.s3site/releases/20200102T000000Z.json",
+		"preview/index.html",
+		"preview/static/app.js",
+		"previewer/index.html",
+		"static/app.js",
+	}
+
+	nested := nestedSites(keys)
+	if !reflect.DeepEqual(nested, []string{"preview/"}) {
+		t.Fatalf("Invalid nested sites: %v", nested)
+	}
+
+	var site []string
+	for _, key := range keys {
+		if !isControlKey(key) && !inNestedSite(key, nested) {
+			site = append(site, key)
+		}
+	}
+
+	expected := []string{"index.html", "preview-notes.txt", "previewer/index.html", "static/app.js"}
+	if !reflect.DeepEqual(site, expected) {
+		t.Errorf("Invalid site keys. expected=%v, actual=%v", expected, site)
+	}
+}
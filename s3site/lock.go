@@ -0,0 +1,360 @@
+package s3site
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// The lock object serializes applies to a site
+const lockKey = controlDir + "lock.json"
+
+// Lease of a lock when the resource does not configure `lock_timeout`
+const defaultLockTimeout = 15 * time.Minute
+
+// Shortest lease accepted, renewals happen every third of it
+const minLockTimeout = 30 * time.Second
+
+// Failed renewals are retried every this fraction of the lease
+const lockRenewRetries = 30
+
+// Error codes of S3 conditional writes that lost against another writer
+const (
+	errCodePreconditionFailed         = "PreconditionFailed"
+	errCodeConditionalRequestConflict = "ConditionalRequestConflict"
+)
+
+type lockInfo struct {
+	ID         string    `json:"id"`
+	Holder     string    `json:"holder"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// siteLock is a lease on the lock object of a site. It is renewed in the
+// background until released so long applies keep it. Once the lock is taken
+// over or the lease runs out without a renewal, the lease is lost: err reports
+// why and the context of the lock is cancelled so changes in flight stop. A
+// nil lock is valid and does nothing.
+type siteLock struct {
+	s3conn  s3iface.S3API
+	bucket  string
+	key     string
+	timeout time.Duration
+
+	mutex sync.Mutex
+	info  lockInfo
+	etag  string
+	lost  error
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// lockSite takes the lock of the site configured by data, unless locking is
+// disabled.
+func lockSite(data resourceGetter, m *Meta) (*siteLock, error) {
+	if data.Get("disable_lock").(bool) {
+		return nil, nil
+	}
+
+	timeout := defaultLockTimeout
+	if v := data.Get("lock_timeout").(string); v != "" {
+		duration, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lock_timeout %q: %s", v, err)
+		}
+		timeout = duration
+	}
+
+	return m.S3Helper.AcquireLock(data.Get("bucket").(string), objectKey(data.Get("prefix").(string), lockKey), timeout)
+}
+
+// validateLockTimeout accepts durations of at least minLockTimeout.
+func validateLockTimeout(v interface{}, k string) (ws []string, errors []error) {
+	duration, err := time.ParseDuration(v.(string))
+	if err != nil {
+		errors = append(errors, fmt.Errorf("%q must be a duration like 15m: %s", k, err))
+	} else if duration < minLockTimeout {
+		errors = append(errors, fmt.Errorf("%q must be at least %s", k, minLockTimeout))
+	}
+
+	return
+}
+
+// AcquireLock creates the lock object at key with a conditional write. A lock
+// held by someone else fails the call unless its lease expired, in which case
+// it is taken over.
+func (s3Helper S3Helper) AcquireLock(bucket string, key string, timeout time.Duration) (*siteLock, error) {
+	return acquireLock(s3.New(s3Helper.session), bucket, key, timeout)
+}
+
+func acquireLock(s3conn s3iface.S3API, bucket string, key string, timeout time.Duration) (*siteLock, error) {
+	l := &siteLock{
+		s3conn:  s3conn,
+		bucket:  bucket,
+		key:     key,
+		timeout: timeout,
+		info: lockInfo{
+			ID:     newLockId(),
+			Holder: lockHolder(),
+		},
+	}
+
+	// A second attempt covers a lock released or taken over while we looked at it
+	for attempt := 0; attempt < 2; attempt++ {
+		acquired, err := l.put("If-None-Match", "*")
+		if err != nil {
+			return nil, err
+		}
+		if acquired {
+			return l.start(), nil
+		}
+
+		current, etag, err := l.read()
+		if err != nil {
+			return nil, err
+		}
+		if current == nil {
+			continue
+		}
+
+		if time.Now().Before(current.ExpiresAt) {
+			return nil, fmt.Errorf("site is locked by %s since %s (lock %s, expires %s). If no apply is running, "+
+				"force unlock by deleting s3://%s/%s", current.Holder, current.AcquiredAt.Format(time.RFC3339),
+				current.ID, current.ExpiresAt.Format(time.RFC3339), bucket, key)
+		}
+
+		log.Printf("[WARN] Taking over expired lock. bucket=%s, key=%s, holder=%s, expired=%s",
+			bucket, key, current.Holder, current.ExpiresAt.Format(time.RFC3339))
+		acquired, err = l.put("If-Match", etag)
+		if err != nil {
+			return nil, err
+		}
+		if acquired {
+			return l.start(), nil
+		}
+	}
+
+	return nil, fmt.Errorf("unable to acquire lock s3://%s/%s, it is changing concurrently", bucket, key)
+}
+
+// start begins renewing the lease of a freshly acquired lock.
+func (l *siteLock) start() *siteLock {
+	log.Printf("[INFO] Acquired lock. bucket=%s, key=%s, id=%s", l.bucket, l.key, l.info.ID)
+
+	l.ctx, l.cancel = context.WithCancelCause(context.Background())
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	go l.renew()
+
+	return l
+}
+
+// put writes the lock with a lease starting now, on the condition given by
+// header. It reports false when the condition did not hold.
+func (l *siteLock) put(header string, value string) (bool, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now().UTC()
+	info := l.info
+	if info.AcquiredAt.IsZero() {
+		info.AcquiredAt = now
+	}
+	info.ExpiresAt = now.Add(l.timeout)
+
+	body, err := json.Marshal(info)
+	if err != nil {
+		return false, err
+	}
+
+	output, err := l.s3conn.PutObjectWithContext(aws.BackgroundContext(), &s3.PutObjectInput{
+		Bucket:      aws.String(l.bucket),
+		Key:         aws.String(l.key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	}, setUploadHeader(header, value))
+	if isAWSErr(err, errCodePreconditionFailed, "") || isAWSErr(err, errCodeConditionalRequestConflict, "") {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("error writing lock s3://%s/%s: %s", l.bucket, l.key, err)
+	}
+
+	l.info = info
+	l.etag = aws.StringValue(output.ETag)
+
+	return true, nil
+}
+
+// read returns the current lock and its ETag, nil when there is none.
+func (l *siteLock) read() (*lockInfo, string, error) {
+	result, err := l.s3conn.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(l.bucket),
+		Key:    aws.String(l.key),
+	})
+	if isAWSErr(err, s3.ErrCodeNoSuchKey, "") {
+		return nil, "", nil
+	} else if err != nil {
+		return nil, "", fmt.Errorf("error reading lock s3://%s/%s: %s", l.bucket, l.key, err)
+	}
+	defer result.Body.Close()
+
+	body, err := ioutil.ReadAll(result.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("error reading lock s3://%s/%s: %s", l.bucket, l.key, err)
+	}
+
+	var info lockInfo
+	if err := json.Unmarshal(body, &info); err != nil {
+		// An unreadable lock is treated as expired so it can be taken over
+		log.Printf("[WARN] Unable to parse lock. bucket=%s, key=%s, err=%s", l.bucket, l.key, err)
+	}
+
+	return &info, aws.StringValue(result.ETag), nil
+}
+
+// renew extends the lease every third of the timeout until the lock is
+// released. Failed renewals are retried until the lease runs out; the lease
+// is only lost early when the lock was taken over.
+func (l *siteLock) renew() {
+	defer close(l.done)
+
+	timer := time.NewTimer(l.timeout / 3)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-timer.C:
+			l.mutex.Lock()
+			etag := l.etag
+			expiresAt := l.info.ExpiresAt
+			l.mutex.Unlock()
+
+			renewed, err := l.put("If-Match", etag)
+			if err == nil && !renewed {
+				l.lose(fmt.Errorf("lock s3://%s/%s was taken over", l.bucket, l.key))
+				return
+			}
+			if err != nil {
+				retry := l.timeout / lockRenewRetries
+				if time.Now().Add(retry).After(expiresAt) {
+					l.lose(fmt.Errorf("lease of lock s3://%s/%s expired: %s", l.bucket, l.key, err))
+					return
+				}
+
+				log.Printf("[WARN] Unable to renew lock, retrying. bucket=%s, key=%s, err=%s", l.bucket, l.key, err)
+				timer.Reset(retry)
+				continue
+			}
+
+			log.Printf("[DEBUG] Renewed lock. bucket=%s, key=%s", l.bucket, l.key)
+			timer.Reset(l.timeout / 3)
+		}
+	}
+}
+
+// lose records why the lease was lost and cancels the context of the lock.
+func (l *siteLock) lose(err error) {
+	log.Printf("[WARN] Unable to renew lock. bucket=%s, key=%s, err=%s", l.bucket, l.key, err)
+	err = fmt.Errorf("lost the lock of the site, stopping to avoid a concurrent apply: %s", err)
+
+	l.mutex.Lock()
+	l.lost = err
+	l.mutex.Unlock()
+
+	l.cancel(err)
+}
+
+// err returns why the lease was lost, nil while it is held.
+func (l *siteLock) err() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.lost
+}
+
+// context returns a context cancelled once the lease is lost.
+func (l *siteLock) context() context.Context {
+	if l == nil {
+		return context.Background()
+	}
+
+	return l.ctx
+}
+
+// release stops renewing the lease and deletes the lock if it is still ours.
+func (l *siteLock) release() {
+	if l == nil {
+		return
+	}
+
+	close(l.stop)
+	<-l.done
+	l.cancel(nil)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.lost != nil {
+		log.Printf("[WARN] Lock was lost during the apply. bucket=%s, key=%s, err=%s", l.bucket, l.key, l.lost)
+	}
+
+	// The delete only succeeds while the lock is unchanged since our last
+	// write, so a lock taken over by another apply stays in place, even when
+	// the lease was lost. Storage
+	// that ignores If-Match on deletes still deletes a lock taken over just
+	// before the delete arrives.
+	_, err := l.s3conn.DeleteObjectWithContext(aws.BackgroundContext(), &s3.DeleteObjectInput{
+		Bucket: aws.String(l.bucket),
+		Key:    aws.String(l.key),
+	}, setUploadHeader("If-Match", l.etag))
+	if isAWSErr(err, errCodePreconditionFailed, "") || isAWSErr(err, errCodeConditionalRequestConflict, "") {
+		log.Printf("[WARN] Lock was replaced, leaving it in place. bucket=%s, key=%s", l.bucket, l.key)
+		return
+	} else if err != nil {
+		log.Printf("[WARN] Unable to release lock. bucket=%s, key=%s, err=%s", l.bucket, l.key, err)
+		return
+	}
+
+	log.Printf("[INFO] Released lock. bucket=%s, key=%s, id=%s", l.bucket, l.key, l.info.ID)
+}
+
+func newLockId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+
+	return fmt.Sprintf("%x", b)
+}
+
+// lockHolder describes the process holding a lock for error messages.
+func lockHolder() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	return fmt.Sprintf("%s (pid %d)", hostname, os.Getpid())
+}
@@ -0,0 +1,330 @@
+package s3site
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// fakeLockS3 keeps objects in memory and honors the conditional writes the
+// lock relies on.
+type fakeLockS3 struct {
+	s3iface.S3API
+
+	mutex   sync.Mutex
+	objects map[string][]byte
+	etags   map[string]string
+	writes  int
+
+	// Number of the next writes failing with a server error
+	failWrites int
+}
+
+func newFakeLockS3() *fakeLockS3 {
+	return &fakeLockS3{objects: make(map[string][]byte), etags: make(map[string]string)}
+}
+
+// set writes key unconditionally, like another client would.
+func (f *fakeLockS3) set(key string, body []byte) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.writes++
+	f.objects[key] = body
+	f.etags[key] = fmt.Sprintf(`"%d"`, f.writes)
+}
+
+func (f *fakeLockS3) get(key string) (lockInfo, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var info lockInfo
+	body, ok := f.objects[key]
+	if ok {
+		json.Unmarshal(body, &info)
+	}
+
+	return info, ok
+}
+
+func (f *fakeLockS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	r := &request.Request{
+		Operation:   &request.Operation{Name: "PutObject"},
+		HTTPRequest: &http.Request{Header: http.Header{}},
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	body, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	key := aws.StringValue(input.Key)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.failWrites > 0 {
+		f.failWrites--
+		return nil, awserr.New("InternalError", "We encountered an internal error. Please try again.", nil)
+	}
+
+	etag, exists := f.etags[key]
+	if r.HTTPRequest.Header.Get("If-None-Match") == "*" && exists {
+		return nil, awserr.New(errCodePreconditionFailed, "At least one of the pre-conditions you specified did not hold", nil)
+	}
+	if ifMatch := r.HTTPRequest.Header.Get("If-Match"); ifMatch != "" && (!exists || ifMatch != etag) {
+		return nil, awserr.New(errCodePreconditionFailed, "At least one of the pre-conditions you specified did not hold", nil)
+	}
+
+	f.writes++
+	f.objects[key] = body
+	f.etags[key] = fmt.Sprintf(`"%d"`, f.writes)
+
+	return &s3.PutObjectOutput{ETag: aws.String(f.etags[key])}, nil
+}
+
+func (f *fakeLockS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	body, ok := f.objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+
+	return &s3.GetObjectOutput{
+		Body: ioutil.NopCloser(bytes.NewReader(body)),
+		ETag: aws.String(f.etags[aws.StringValue(input.Key)]),
+	}, nil
+}
+
+func (f *fakeLockS3) DeleteObjectWithContext(ctx aws.Context, input *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error) {
+	r := &request.Request{
+		Operation:   &request.Operation{Name: "DeleteObject"},
+		HTTPRequest: &http.Request{Header: http.Header{}},
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	etag, exists := f.etags[aws.StringValue(input.Key)]
+	if ifMatch := r.HTTPRequest.Header.Get("If-Match"); ifMatch != "" && exists && ifMatch != etag {
+		return nil, awserr.New(errCodePreconditionFailed, "At least one of the pre-conditions you specified did not hold", nil)
+	}
+
+	delete(f.objects, aws.StringValue(input.Key))
+	delete(f.etags, aws.StringValue(input.Key))
+
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func TestAcquireLock(t *testing.T) {
+	fake := newFakeLockS3()
+
+	l, err := acquireLock(fake, "bucket", lockKey, time.Minute)
+	if err != nil {
+		t.Fatalf("Unable to acquire lock: %s", err)
+	}
+
+	info, ok := fake.get(lockKey)
+	if !ok || info.ID != l.info.ID || !info.ExpiresAt.After(time.Now()) {
+		t.Errorf("Invalid lock object: %v", info)
+	}
+
+	// A held lock is not taken over
+	if _, err := acquireLock(fake, "bucket", lockKey, time.Minute); err == nil || !strings.Contains(err.Error(), "force unlock") {
+		t.Errorf("Invalid error for a held lock: %v", err)
+	}
+
+	if err := l.err(); err != nil {
+		t.Errorf("Unexpected lock error: %s", err)
+	}
+
+	l.release()
+	if _, ok := fake.get(lockKey); ok {
+		t.Error("Lock was not deleted on release")
+	}
+}
+
+func TestAcquireLockTakeover(t *testing.T) {
+	expired, _ := json.Marshal(lockInfo{ID: "old", Holder: "crashed", ExpiresAt: time.Now().Add(-time.Minute)})
+
+	for name, body := range map[string][]byte{"expired": expired, "unreadable": []byte("{not json")} {
+		fake := newFakeLockS3()
+		fake.set(lockKey, body)
+
+		l, err := acquireLock(fake, "bucket", lockKey, time.Minute)
+		if err != nil {
+			t.Errorf("Unable to take over %s lock: %s", name, err)
+			continue
+		}
+
+		if info, _ := fake.get(lockKey); info.ID != l.info.ID {
+			t.Errorf("The %s lock was not replaced: %v", name, info)
+		}
+		l.release()
+	}
+}
+
+func TestLockRenewAndLose(t *testing.T) {
+	fake := newFakeLockS3()
+
+	timeout := 150 * time.Millisecond
+	l, err := acquireLock(fake, "bucket", lockKey, timeout)
+	if err != nil {
+		t.Fatalf("Unable to acquire lock: %s", err)
+	}
+	acquired, _ := fake.get(lockKey)
+
+	// Renewed every third of the timeout
+	time.Sleep(timeout * 2 / 3)
+	renewed, _ := fake.get(lockKey)
+	if !renewed.ExpiresAt.After(acquired.ExpiresAt) || !renewed.AcquiredAt.Equal(acquired.AcquiredAt) {
+		t.Errorf("Lock was not renewed. acquired=%v, renewed=%v", acquired, renewed)
+	}
+	if err := l.err(); err != nil {
+		t.Fatalf("Unexpected lock error: %s", err)
+	}
+
+	// Someone else taking over the lock makes the next renewal fail
+	other, _ := json.Marshal(lockInfo{ID: "other", ExpiresAt: time.Now().Add(time.Hour)})
+	fake.set(lockKey, other)
+
+	select {
+	case <-l.context().Done():
+	case <-time.After(10 * timeout):
+		t.Fatal("Context was not cancelled after losing the lock")
+	}
+	if err := l.err(); err == nil || !strings.Contains(err.Error(), "taken over") {
+		t.Errorf("Invalid lock error: %v", err)
+	}
+
+	// The lock of the other apply is left alone
+	l.release()
+	if info, ok := fake.get(lockKey); !ok || info.ID != "other" {
+		t.Errorf("Lock of another apply was released: %v", info)
+	}
+}
+
+func TestLockRenewRetry(t *testing.T) {
+	fake := newFakeLockS3()
+
+	timeout := 150 * time.Millisecond
+	l, err := acquireLock(fake, "bucket", lockKey, timeout)
+	if err != nil {
+		t.Fatalf("Unable to acquire lock: %s", err)
+	}
+	acquired, _ := fake.get(lockKey)
+
+	// A failed renewal is retried while the lease lasts
+	fake.mutex.Lock()
+	fake.failWrites = 1
+	fake.mutex.Unlock()
+
+	time.Sleep(timeout)
+	renewed, _ := fake.get(lockKey)
+	if !renewed.ExpiresAt.After(acquired.ExpiresAt) {
+		t.Errorf("Lock was not renewed after a failure. acquired=%v, renewed=%v", acquired, renewed)
+	}
+	if err := l.err(); err != nil {
+		t.Errorf("Lease was lost after a single failed renewal: %s", err)
+	}
+
+	l.release()
+	if _, ok := fake.get(lockKey); ok {
+		t.Error("Lock was not deleted on release")
+	}
+}
+
+func TestLockLeaseExpired(t *testing.T) {
+	fake := newFakeLockS3()
+
+	timeout := 150 * time.Millisecond
+	l, err := acquireLock(fake, "bucket", lockKey, timeout)
+	if err != nil {
+		t.Fatalf("Unable to acquire lock: %s", err)
+	}
+
+	fake.mutex.Lock()
+	fake.failWrites = 1000
+	fake.mutex.Unlock()
+
+	select {
+	case <-l.context().Done():
+	case <-time.After(10 * timeout):
+		t.Fatal("Context was not cancelled after the lease expired")
+	}
+	if err := l.err(); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("Invalid lock error: %v", err)
+	}
+
+	// The lock is still ours, so it is released anyway
+	l.release()
+	if _, ok := fake.get(lockKey); ok {
+		t.Error("Lock was not deleted after the lease was lost")
+	}
+}
+
+func TestReleaseReplacedLock(t *testing.T) {
+	fake := newFakeLockS3()
+
+	l, err := acquireLock(fake, "bucket", lockKey, time.Minute)
+	if err != nil {
+		t.Fatalf("Unable to acquire lock: %s", err)
+	}
+
+	other, _ := json.Marshal(lockInfo{ID: "other", ExpiresAt: time.Now().Add(time.Hour)})
+	fake.set(lockKey, other)
+
+	l.release()
+	if info, ok := fake.get(lockKey); !ok || info.ID != "other" {
+		t.Errorf("Replaced lock was deleted: %v", info)
+	}
+}
+
+func TestNilLock(t *testing.T) {
+	var l *siteLock
+
+	if err := l.err(); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if l.context().Err() != nil {
+		t.Error("Context of a disabled lock is cancelled")
+	}
+	l.release()
+}
+
+func TestValidateLockTimeout(t *testing.T) {
+	cases := map[string]bool{
+		"15m":   true,
+		"30s":   true,
+		"29s":   false,
+		"-1h":   false,
+		"never": false,
+	}
+
+	for value, valid := range cases {
+		_, errors := validateLockTimeout(value, "lock_timeout")
+		if (len(errors) == 0) != valid {
+			t.Errorf("Invalid validation of %q: %v", value, errors)
+		}
+	}
+}
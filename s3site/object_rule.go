@@ -0,0 +1,399 @@
+package s3site
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+// objectRule overrides the headers and metadata of the objects whose key
+// matches Pattern. Empty fields leave the value of earlier rules in place.
+type objectRule struct {
+	Pattern            string
+	CacheControl       string
+	ContentType        string
+	ContentEncoding    string
+	ContentDisposition string
+	ContentLanguage    string
+	Expires            string
+	Metadata           map[string]string
+	ACL                string
+	StorageClass       string
+	Tags               map[string]string
+}
+
+// Maximum number of tags S3 accepts on an object
+const maxObjectTags = 10
+
+// expiresNone as the `expires` of a rule removes the Expires header set by
+// earlier rules.
+const expiresNone = "none"
+
+// defaultObjectRules are evaluated before the configured rules. They keep
+// browsers from caching the entry page so new releases are picked up.
+var defaultObjectRules = []objectRule{
+	{
+		Pattern:      "**/index.html",
+		CacheControl: "no-cache, no-store, must-revalidate",
+		Expires:      "0",
+	},
+}
+
+func objectRuleSchema() *schema.Schema {
+	return &schema.Schema{
+		Type:     schema.TypeList,
+		Optional: true,
+		Description: "Headers and metadata for the objects matching `pattern`. Rules are applied in order " +
+			"after the built-in index.html rule, which sets `cache_control` and `expires`; for every field the last matching rule setting it wins " +
+			"and `metadata` is merged key by key.",
+		Elem: &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"pattern": {
+					Type:         schema.TypeString,
+					Required:     true,
+					Description:  "Glob pattern matched against the object key.",
+					ValidateFunc: validateGlob,
+				},
+				"cache_control": {
+					Type:     schema.TypeString,
+					Optional: true,
+				},
+				"content_type": {
+					Type:     schema.TypeString,
+					Optional: true,
+				},
+				"content_encoding": {
+					Type:     schema.TypeString,
+					Optional: true,
+				},
+				"content_disposition": {
+					Type:     schema.TypeString,
+					Optional: true,
+				},
+				"content_language": {
+					Type:     schema.TypeString,
+					Optional: true,
+				},
+				"expires": {
+					Type:     schema.TypeString,
+					Optional: true,
+					Description: "Seconds after the upload the `Expires` header is set to, or `none` to leave the header " +
+						"out.",
+					ValidateFunc: validateExpires,
+				},
+				"metadata": {
+					Type:     schema.TypeMap,
+					Optional: true,
+					Elem:     &schema.Schema{Type: schema.TypeString},
+				},
+				"acl":           objectACLSchema(),
+				"storage_class": objectStorageClassSchema(),
+				"tags":          objectTagsSchema(),
+			},
+		},
+	}
+}
+
+func objectACLSchema() *schema.Schema {
+	return &schema.Schema{
+		Type:         schema.TypeString,
+		Optional:     true,
+		Description:  "Canned ACL of the objects. The bucket default applies when not set.",
+		ValidateFunc: validation.StringInSlice(s3.ObjectCannedACL_Values(), false),
+	}
+}
+
+func objectStorageClassSchema() *schema.Schema {
+	return &schema.Schema{
+		Type:         schema.TypeString,
+		Optional:     true,
+		Description:  "Storage class of the objects, `STANDARD` when not set.",
+		ValidateFunc: validation.StringInSlice(s3.StorageClass_Values(), false),
+	}
+}
+
+func objectTagsSchema() *schema.Schema {
+	return &schema.Schema{
+		Type:        schema.TypeMap,
+		Optional:    true,
+		Elem:        &schema.Schema{Type: schema.TypeString},
+		Description: "Tags of the objects. Tag changes are applied without uploading the objects again.",
+	}
+}
+
+func expandObjectRules(list []interface{}) []objectRule {
+	rules := make([]objectRule, 0, len(list))
+	for _, v := range list {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		rule := objectRule{
+			Pattern:            m["pattern"].(string),
+			CacheControl:       m["cache_control"].(string),
+			ContentType:        m["content_type"].(string),
+			ContentEncoding:    m["content_encoding"].(string),
+			ContentDisposition: m["content_disposition"].(string),
+			ContentLanguage:    m["content_language"].(string),
+			Expires:            m["expires"].(string),
+			Metadata:           expandStringMap(m["metadata"]),
+			ACL:                m["acl"].(string),
+			StorageClass:       m["storage_class"].(string),
+			Tags:               expandStringMap(m["tags"]),
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+// applyObjectRules runs the default rules followed by rules against the file.
+func applyObjectRules(fi fileInfo, rules []objectRule) fileInfo {
+	allRules := append(append([]objectRule{}, defaultObjectRules...), rules...)
+
+	for _, rule := range allRules {
+		if !globMatch(rule.Pattern, fi.RelativePath) {
+			continue
+		}
+
+		if rule.CacheControl != "" {
+			fi.CacheControl = rule.CacheControl
+		}
+		if rule.ContentType != "" {
+			fi.ContentType = rule.ContentType
+		}
+		if rule.ContentEncoding != "" {
+			fi.ContentEncoding = rule.ContentEncoding
+		}
+		if rule.ContentDisposition != "" {
+			fi.ContentDisposition = rule.ContentDisposition
+		}
+		if rule.ContentLanguage != "" {
+			fi.ContentLanguage = rule.ContentLanguage
+		}
+		if rule.Expires == expiresNone {
+			fi.Expires = ""
+		} else if rule.Expires != "" {
+			fi.Expires = rule.Expires
+		}
+
+		if rule.ACL != "" {
+			fi.ACL = rule.ACL
+		}
+		if rule.StorageClass != "" {
+			fi.StorageClass = rule.StorageClass
+		}
+
+		if len(rule.Metadata) > 0 {
+			fi.Metadata = mergeStringMaps(fi.Metadata, rule.Metadata)
+		}
+		if len(rule.Tags) > 0 {
+			fi.Tags = mergeStringMaps(fi.Tags, rule.Tags)
+		}
+	}
+
+	return fi
+}
+
+func validateExpires(v interface{}, k string) (ws []string, errors []error) {
+	value := v.(string)
+	if value == expiresNone {
+		return
+	}
+
+	if secs, err := strconv.ParseInt(value, 10, 64); err != nil || secs < 0 {
+		errors = append(errors, fmt.Errorf("%q must be a number of seconds or %q, got %q", k, expiresNone, value))
+	}
+
+	return
+}
+
+// mergeStringMaps returns a new map with the entries of b layered over a.
+func mergeStringMaps(a map[string]string, b map[string]string) map[string]string {
+	merged := make(map[string]string)
+	for key, value := range a {
+		merged[key] = value
+	}
+	for key, value := range b {
+		merged[key] = value
+	}
+
+	return merged
+}
+
+func expandStringMap(v interface{}) map[string]string {
+	result := make(map[string]string)
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return result
+	}
+
+	for key, value := range m {
+		result[key] = value.(string)
+	}
+
+	return result
+}
+
+// User metadata written by the provider next to the configured metadata
+const (
+	// ETag form content hash of the uploaded file, used instead of the ETag
+	// under SSE-KMS. See checksumMetadataKey for the other algorithms.
+	metadataContentHash = "s3site-md5"
+	// Encryption settings the object was uploaded with
+	metadataEncryption = "s3site-sse"
+	// Canned ACL the object was uploaded with, S3 does not return it with the headers
+	metadataACL = "s3site-acl"
+	// Configured Expires in seconds, the header itself is a date relative to the upload
+	metadataExpires = "s3site-expires"
+)
+
+// uploadMetadata returns the configured metadata together with the metadata
+// the provider records about the upload.
+func (f fileInfo) uploadMetadata() map[string]string {
+	metadata := make(map[string]string)
+	for key, value := range f.Metadata {
+		metadata[key] = value
+	}
+
+	if f.Hash != "" {
+		metadata[checksumMetadataKey(f.ChecksumAlgorithm)] = f.Hash
+	}
+
+	if f.ServerSideEncryption != "" {
+		encryption := f.ServerSideEncryption
+		if f.SSEKMSKeyId != "" {
+			encryption += ":" + f.SSEKMSKeyId
+		}
+		if f.BucketKeyEnabled {
+			encryption += ":bucket-key"
+		}
+		metadata[metadataEncryption] = encryption
+	}
+
+	if f.ACL != "" {
+		metadata[metadataACL] = f.ACL
+	}
+
+	if f.Expires != "" {
+		metadata[metadataExpires] = f.Expires
+	}
+
+	return metadata
+}
+
+// headMetadata looks up user metadata of an object regardless of the
+// canonicalization S3 applied to the key.
+func headMetadata(head *s3.HeadObjectOutput, name string) string {
+	for key, value := range head.Metadata {
+		if strings.EqualFold(key, name) {
+			return aws.StringValue(value)
+		}
+	}
+
+	return ""
+}
+
+// metadataFingerprint hashes the headers and user metadata of an object so
+// header changes can be detected without storing every value in state.
+// Expires is compared through the configured value in the metadata since
+// the header is rendered relative to the upload time.
+func (f fileInfo) metadataFingerprint() string {
+	metadataKeys := make([]string, 0, len(f.Metadata))
+	metadata := make(map[string]string)
+	for key, value := range f.uploadMetadata() {
+		// S3 returns user metadata keys canonicalized, so compare them case insensitively
+		key = strings.ToLower(key)
+
+		// The content checksum is compared on its own
+		if isChecksumMetadataKey(key) {
+			continue
+		}
+
+		metadataKeys = append(metadataKeys, key)
+		metadata[key] = value
+	}
+	sort.Strings(metadataKeys)
+
+	hash := sha256.New()
+	for _, value := range []string{f.ContentType, f.CacheControl, f.ContentEncoding, f.ContentDisposition, f.ContentLanguage} {
+		fmt.Fprintf(hash, "%q\n", value)
+	}
+	for _, key := range metadataKeys {
+		fmt.Fprintf(hash, "%q=%q\n", key, metadata[key])
+	}
+
+	// S3 leaves the storage class out of the headers for STANDARD objects
+	if f.StorageClass != "" && f.StorageClass != s3.StorageClassStandard {
+		fmt.Fprintf(hash, "storage-class=%q\n", f.StorageClass)
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil))[:16]
+}
+
+// tagsFingerprint hashes the tags of an object, it is empty without tags.
+func tagsFingerprint(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%q=%q\n", key, tags[key])
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil))[:16]
+}
+
+// uploadTagging encodes the tags of the file for the x-amz-tagging header.
+func (f fileInfo) uploadTagging() string {
+	tagging := url.Values{}
+	for key, value := range f.Tags {
+		tagging.Set(key, value)
+	}
+
+	return tagging.Encode()
+}
+
+// headFileInfo converts the headers of an uploaded object back into the
+// fileInfo fields produced by decorateMap.
+func headFileInfo(head *s3.HeadObjectOutput) fileInfo {
+	return fileInfo{
+		ContentType:        aws.StringValue(head.ContentType),
+		CacheControl:       aws.StringValue(head.CacheControl),
+		ContentEncoding:    aws.StringValue(head.ContentEncoding),
+		ContentDisposition: aws.StringValue(head.ContentDisposition),
+		ContentLanguage:    aws.StringValue(head.ContentLanguage),
+		Metadata:           aws.StringValueMap(head.Metadata),
+		StorageClass:       aws.StringValue(head.StorageClass),
+	}
+}
+
+// headFileInfoExpires is headFileInfo for an object whose rules configure
+// expires. Objects uploaded with an Expires header before `s3site-expires` was
+// recorded are taken to carry the configured value, so they are not uploaded
+// again only to record it.
+func headFileInfoExpires(head *s3.HeadObjectOutput, expires string) fileInfo {
+	fi := headFileInfo(head)
+	if expires != "" && aws.StringValue(head.Expires) != "" && headMetadata(head, metadataExpires) == "" {
+		fi.Metadata[metadataExpires] = expires
+	}
+
+	return fi
+}
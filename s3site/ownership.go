@@ -0,0 +1,58 @@
+package s3site
+
+// Ways a site marks the objects it uploads as its own
+const (
+	// Mark objects with user metadata, changing the mode uploads them again
+	ownershipMetadata = "METADATA"
+	// Mark objects with a tag, changing the mode only retags them
+	ownershipTag = "TAG"
+)
+
+var ownershipModes = []string{
+	ownershipMetadata,
+	ownershipTag,
+}
+
+// Metadata key or tag holding the id of the site owning an object
+const ownerKey = "s3site-owner"
+
+// ownership decides which objects below the prefix belong to a site. Without
+// a mode every object belongs to the site.
+type ownership struct {
+	Mode  string
+	Owner string
+	Adopt bool
+}
+
+func siteOwnership(d resourceGetter) ownership {
+	return ownership{
+		Mode:  d.Get("ownership").(string),
+		Owner: siteId(d.Get("bucket").(string), d.Get("prefix").(string)),
+		Adopt: d.Get("adopt_existing").(bool),
+	}
+}
+
+// owns reports whether an object carrying owner as its marker belongs to the
+// site. Unmarked objects are adopted when configured, objects marked by
+// another site never are.
+func (o ownership) owns(owner string) bool {
+	if o.Mode == "" || owner == o.Owner {
+		return true
+	}
+
+	return o.Adopt && owner == ""
+}
+
+// mark adds the marker of the site to the file.
+func (o ownership) mark(fi fileInfo) fileInfo {
+	marker := map[string]string{ownerKey: o.Owner}
+
+	switch o.Mode {
+	case ownershipMetadata:
+		fi.Metadata = mergeStringMaps(fi.Metadata, marker)
+	case ownershipTag:
+		fi.Tags = mergeStringMaps(fi.Tags, marker)
+	}
+
+	return fi
+}
@@ -0,0 +1,48 @@
+package s3site
+
+import (
+	"testing"
+)
+
+func TestOwnershipOwns(t *testing.T) {
+	cases := []struct {
+		ownership ownership
+		marker    string
+		expected  bool
+	}{
+		{ownership{}, "", true},
+		{ownership{}, "bucket/other", true},
+		{ownership{Mode: ownershipMetadata, Owner: "bucket/site"}, "bucket/site", true},
+		{ownership{Mode: ownershipMetadata, Owner: "bucket/site"}, "", false},
+		{ownership{Mode: ownershipTag, Owner: "bucket/site"}, "bucket/other", false},
+		{ownership{Mode: ownershipTag, Owner: "bucket/site", Adopt: true}, "", true},
+		{ownership{Mode: ownershipTag, Owner: "bucket/site", Adopt: true}, "bucket/other", false},
+	}
+
+	for _, c := range cases {
+		if actual := c.ownership.owns(c.marker); actual != c.expected {
+			t.Errorf("Invalid ownership of %q for %+v. expected=%t, actual=%t", c.marker, c.ownership, c.expected, actual)
+		}
+	}
+}
+
+func TestOwnershipMark(t *testing.T) {
+	fi := fileInfo{
+		Metadata: map[string]string{"team": "web"},
+		Tags:     map[string]string{"release": "42"},
+	}
+
+	marked := ownership{Mode: ownershipMetadata, Owner: "bucket/site"}.mark(fi)
+	if marked.Metadata[ownerKey] != "bucket/site" || marked.Metadata["team"] != "web" || len(marked.Tags) != 1 {
+		t.Errorf("Invalid metadata marker: %+v", marked)
+	}
+
+	marked = ownership{Mode: ownershipTag, Owner: "bucket/site"}.mark(fi)
+	if marked.Tags[ownerKey] != "bucket/site" || marked.Tags["release"] != "42" || len(marked.Metadata) != 1 {
+		t.Errorf("Invalid tag marker: %+v", marked)
+	}
+
+	if _, ok := fi.Tags[ownerKey]; ok {
+		t.Error("Marking modified the original tags")
+	}
+}
@@ -0,0 +1,132 @@
+package s3site
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// planSummary counts what an apply does to the objects of a site. It is only
+// planned when objects change and then kept in state as planned, so it
+// describes the last apply that changed objects and plans without changes
+// show no difference.
+type planSummary struct {
+	Upload          int
+	Delete          int
+	Unchanged       int
+	MetadataChanges int
+	Bytes           int64
+}
+
+// summarizeChanges compares the objects in state with the planned ones.
+// Objects whose headers, metadata or tags change but whose content does not
+// count as metadata changes; they are part of the uploads unless only their
+// tags change.
+func summarizeChanges(oldObjects map[string]siteObject, newObjects map[string]siteObject) planSummary {
+	changed, removed := diffObjects(oldObjects, newObjects)
+	retagged := diffTags(oldObjects, newObjects, changed)
+
+	s := planSummary{
+		Upload:          len(changed),
+		Delete:          len(removed),
+		Unchanged:       len(newObjects) - len(changed) - len(retagged),
+		MetadataChanges: len(retagged),
+	}
+
+	for key, object := range changed {
+		s.Bytes += object.Size
+
+		if oldObject, ok := oldObjects[key]; ok && oldObject.Checksum == object.Checksum {
+			s.MetadataChanges++
+		}
+	}
+
+	return s
+}
+
+func (s planSummary) String() string {
+	if s.Upload == 0 && s.Delete == 0 && s.MetadataChanges == 0 {
+		return "no changes"
+	}
+
+	parts := []string{
+		fmt.Sprintf("%d %s (%s)", s.Upload, plural(s.Upload, "upload", "uploads"), formatBytes(s.Bytes)),
+		fmt.Sprintf("%d %s", s.Delete, plural(s.Delete, "delete", "deletes")),
+	}
+	if s.MetadataChanges > 0 {
+		parts = append(parts, fmt.Sprintf("%d %s", s.MetadataChanges, plural(s.MetadataChanges, "metadata change", "metadata changes")))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// set stores the summary with set, either ResourceData.Set or
+// ResourceDiff.SetNew.
+func (s planSummary) set(set func(key string, value interface{}) error) {
+	set("files_to_upload", s.Upload)
+	set("files_to_delete", s.Delete)
+	set("files_unchanged", s.Unchanged)
+	set("bytes_to_upload", int(s.Bytes))
+	set("metadata_changes", s.MetadataChanges)
+	set("change_summary", s.String())
+}
+
+func planSummarySchema() map[string]*schema.Schema {
+	return map[string]*schema.Schema{
+		"files_to_upload": {
+			Type:        schema.TypeInt,
+			Computed:    true,
+			Description: "Number of objects uploaded by the last plan that changed objects.",
+		},
+		"files_to_delete": {
+			Type:        schema.TypeInt,
+			Computed:    true,
+			Description: "Number of objects removed from the site by the last plan that changed objects.",
+		},
+		"files_unchanged": {
+			Type:        schema.TypeInt,
+			Computed:    true,
+			Description: "Number of objects left untouched by the last plan that changed objects.",
+		},
+		"bytes_to_upload": {
+			Type:        schema.TypeInt,
+			Computed:    true,
+			Description: "Total size of the objects uploaded by the last plan that changed objects.",
+		},
+		"metadata_changes": {
+			Type:        schema.TypeInt,
+			Computed:    true,
+			Description: "Number of objects whose headers, metadata or tags changed without a content change in the last plan that changed objects.",
+		},
+		"change_summary": {
+			Type:        schema.TypeString,
+			Computed:    true,
+			Description: "Human readable summary of the last plan that changed objects, e.g. `12 uploads (4.2 MB), 3 deletes`.",
+		},
+	}
+}
+
+func plural(n int, singular string, plural string) string {
+	if n == 1 {
+		return singular
+	}
+
+	return plural
+}
+
+// formatBytes renders a size with decimal units.
+func formatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
@@ -0,0 +1,53 @@
+package s3site
+
+import (
+	"testing"
+)
+
+func TestSummarizeChanges(t *testing.T) {
+	oldObjects := map[string]siteObject{
+		"index.html":     {Key: "index.html", Checksum: "a", MetadataHash: "m", Size: 100},
+		"static/v1.js":   {Key: "static/v1.js", Checksum: "b", MetadataHash: "m", Size: 1000},
+		"static/app.css": {Key: "static/app.css", Checksum: "c", MetadataHash: "m", Size: 10},
+		"logo.svg":       {Key: "logo.svg", Checksum: "d", MetadataHash: "m", Size: 10},
+		"favicon.ico":    {Key: "favicon.ico", Checksum: "e", MetadataHash: "m", Size: 10},
+	}
+	newObjects := map[string]siteObject{
+		"index.html":     {Key: "index.html", Checksum: "f", MetadataHash: "m", Size: 120},
+		"static/v2.js":   {Key: "static/v2.js", Checksum: "g", MetadataHash: "m", Size: 4200000},
+		"static/app.css": {Key: "static/app.css", Checksum: "c", MetadataHash: "n", Size: 10},
+		"logo.svg":       {Key: "logo.svg", Checksum: "d", MetadataHash: "m", Size: 10, TagsHash: "t"},
+		"favicon.ico":    {Key: "favicon.ico", Checksum: "e", MetadataHash: "m", Size: 10},
+	}
+
+	s := summarizeChanges(oldObjects, newObjects)
+
+	expected := planSummary{Upload: 3, Delete: 1, Unchanged: 1, MetadataChanges: 2, Bytes: 4200130}
+	if s != expected {
+		t.Errorf("Invalid summary. expected=%+v, actual=%+v", expected, s)
+	}
+
+	if s.String() != "3 uploads (4.2 MB), 1 delete, 2 metadata changes" {
+		t.Errorf("Invalid summary text: %s", s)
+	}
+
+	if summary := summarizeChanges(newObjects, newObjects); summary != (planSummary{Unchanged: len(newObjects)}) || summary.String() != "no changes" {
+		t.Errorf("Invalid summary without changes: %+v", summary)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	cases := map[int64]string{
+		0:          "0 B",
+		999:        "999 B",
+		1500:       "1.5 kB",
+		4200000:    "4.2 MB",
+		3000000000: "3.0 GB",
+	}
+
+	for n, expected := range cases {
+		if actual := formatBytes(n); actual != expected {
+			t.Errorf("Invalid format of %d. expected=%s, actual=%s", n, expected, actual)
+		}
+	}
+}
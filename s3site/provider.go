@@ -6,14 +6,17 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/hashicorp/terraform/helper/hashcode"
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
 	"github.com/hashicorp/terraform/terraform"
 	homedir "github.com/mitchellh/go-homedir"
 	"log"
 )
 
 type Meta struct {
-	Session  *session.Session
-	S3Helper *S3Helper
+	Session     *session.Session
+	S3Helper    *S3Helper
+	Parallelism int
+	WorkDir     string
 }
 
 func Provider() terraform.ResourceProvider {
@@ -156,6 +159,21 @@ func Provider() terraform.ResourceProvider {
 				Default:     false,
 				Description: descriptions["s3_force_path_style"],
 			},
+
+			"parallelism": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      10,
+				Description:  descriptions["parallelism"],
+				ValidateFunc: validation.IntAtLeast(1),
+			},
+
+			"work_dir": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "",
+				Description: descriptions["work_dir"],
+			},
 		},
 		ResourcesMap: map[string]*schema.Resource{
 			"s3site_site":                    resourceSite(),
@@ -163,6 +181,7 @@ func Provider() terraform.ResourceProvider {
 		},
 		DataSourcesMap: map[string]*schema.Resource{
 			"s3site_artifactory": dataSourceArtifactory(),
+			"s3site_releases":    dataSourceReleases(),
 			"s3site_s3":          dataSourceS3(),
 		},
 		ConfigureFunc: providerConfigure,
@@ -254,6 +273,14 @@ func init() {
 			"use virtual hosted bucket addressing when possible\n" +
 			"(http://BUCKET.s3.amazonaws.com/KEY). Specific to the Amazon S3 service.",
 
+		"parallelism": "The default number of concurrent object uploads per site.\n" +
+			"Can be overridden with `parallelism` on the resource.",
+
+		"work_dir": "Directory archives are extracted and artifacts downloaded to.\n" +
+			"Every site and data source gets its own directory below it. Downloads are kept\n" +
+			"for a day after the last read so a saved plan can still deploy them.\n" +
+			"Defaults to `s3site` in the system temporary directory.",
+
 		"assume_role_role_arn": "The ARN of an IAM role to assume prior to making API calls.",
 
 		"assume_role_session_name": "The session name to use when assuming the role. If omitted," +
@@ -351,9 +378,19 @@ func providerConfigure(d *schema.ResourceData) (interface{}, error) {
 	if err != nil {
 		panic(err)
 	}
+	workDir, err := homedir.Expand(d.Get("work_dir").(string))
+	if err != nil {
+		return nil, err
+	}
+	if workDir == "" {
+		workDir = defaultWorkDir()
+	}
+
 	return &Meta{
-		Session:  sess,
-		S3Helper: NewS3Helper(sess),
+		Session:     sess,
+		S3Helper:    NewS3Helper(sess),
+		Parallelism: d.Get("parallelism").(int),
+		WorkDir:     workDir,
 	}, nil
 }
 
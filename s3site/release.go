@@ -0,0 +1,290 @@
+package s3site
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Every deployment records a manifest of its objects below releasesDir
+const releasesDir = controlDir + "releases/"
+
+// Format of release ids, sortable by the time the release was deployed. A
+// random suffix keeps releases deployed at the same time apart.
+const releaseIdFormat = "20060102T150405.000000Z"
+
+// Number of releases kept when the resource does not configure `keep_releases`
+const defaultKeepReleases = 20
+
+// release is the manifest of a deployment. It holds the object versions
+// needed to restore the site as it was deployed.
+type release struct {
+	ID        string          `json:"id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Source    releaseSource   `json:"source"`
+	Objects   []releaseObject `json:"objects"`
+}
+
+// releaseSource describes where the objects of a release came from.
+type releaseSource struct {
+	Path       string `json:"path,omitempty"`
+	SourceDir  string `json:"source_dir,omitempty"`
+	SHA256     string `json:"sha256,omitempty"`
+	RollbackOf string `json:"rollback_of,omitempty"`
+}
+
+type releaseObject struct {
+	Key          string `json:"key"`
+	ETag         string `json:"etag,omitempty"`
+	Checksum     string `json:"checksum"`
+	Size         int64  `json:"size"`
+	ContentType  string `json:"content_type,omitempty"`
+	CacheControl string `json:"cache_control,omitempty"`
+	VersionId    string `json:"version_id,omitempty"`
+	MetadataHash string `json:"metadata_hash"`
+	TagsHash     string `json:"tags_hash,omitempty"`
+}
+
+func releaseKey(id string) string {
+	return releasesDir + id + ".json"
+}
+
+func newRelease(now time.Time, source releaseSource, objects map[string]siteObject) release {
+	now = now.UTC().Truncate(time.Microsecond)
+
+	r := release{
+		ID:        newReleaseId(now),
+		CreatedAt: now,
+		Source:    source,
+		Objects:   make([]releaseObject, 0, len(objects)),
+	}
+
+	for _, key := range sortedObjectKeys(objects) {
+		object := objects[key]
+		r.Objects = append(r.Objects, releaseObject{
+			Key:          object.Key,
+			ETag:         object.ETag,
+			Checksum:     object.Checksum,
+			Size:         object.Size,
+			ContentType:  object.ContentType,
+			CacheControl: object.CacheControl,
+			VersionId:    object.VersionId,
+			MetadataHash: object.MetadataHash,
+			TagsHash:     object.TagsHash,
+		})
+	}
+
+	return r
+}
+
+func newReleaseId(now time.Time) string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return now.Format(releaseIdFormat)
+	}
+
+	return fmt.Sprintf("%s-%x", now.Format(releaseIdFormat), b)
+}
+
+func (r release) siteObjects() map[string]siteObject {
+	objects := make(map[string]siteObject)
+	for _, object := range r.Objects {
+		objects[object.Key] = siteObject{
+			Key:          object.Key,
+			ETag:         object.ETag,
+			Checksum:     object.Checksum,
+			Size:         object.Size,
+			ContentType:  object.ContentType,
+			CacheControl: object.CacheControl,
+			VersionId:    object.VersionId,
+			MetadataHash: object.MetadataHash,
+			TagsHash:     object.TagsHash,
+		}
+	}
+
+	return objects
+}
+
+// planRollback returns the objects of the release to restore over the current
+// objects. Objects that differ from the current ones are copied back from
+// their recorded version, so they must have one.
+func planRollback(r release, current map[string]siteObject) (map[string]siteObject, error) {
+	objects := r.siteObjects()
+
+	var unversioned []string
+	for key, object := range objects {
+		if currentObject, ok := current[key]; ok && currentObject.Checksum == object.Checksum &&
+			currentObject.MetadataHash == object.MetadataHash && currentObject.TagsHash == object.TagsHash {
+			continue
+		}
+
+		if object.VersionId == "" {
+			unversioned = append(unversioned, key)
+		}
+	}
+
+	if len(unversioned) > 0 {
+		sort.Strings(unversioned)
+		return nil, fmt.Errorf("release %s cannot be restored, the bucket was not versioned when it was deployed: %s",
+			r.ID, strings.Join(truncateKeys(unversioned, 10), ", "))
+	}
+
+	return objects, nil
+}
+
+// truncateKeys shortens a list of keys for error messages.
+func truncateKeys(keys []string, max int) []string {
+	if len(keys) <= max {
+		return keys
+	}
+
+	return append(append([]string{}, keys[:max]...), fmt.Sprintf("and %d more", len(keys)-max))
+}
+
+// siteSource describes the source of the release being deployed.
+func siteSource(d resourceGetter) (releaseSource, error) {
+	if rollbackTo := d.Get("rollback_to").(string); rollbackTo != "" {
+		return releaseSource{RollbackOf: rollbackTo}, nil
+	}
+
+	if sourceDir := d.Get("source_dir").(string); sourceDir != "" {
+		return releaseSource{SourceDir: sourceDir}, nil
+	}
+
+	path := d.Get("path").(string)
+	file, err := os.Open(path)
+	if err != nil {
+		return releaseSource{}, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return releaseSource{}, err
+	}
+
+	return releaseSource{Path: path, SHA256: fmt.Sprintf("%x", hash.Sum(nil))}, nil
+}
+
+func (s3Helper S3Helper) readRelease(bucket string, prefix string, id string) (release, error) {
+	var r release
+
+	key := objectKey(prefix, releaseKey(id))
+	body, err := s3Helper.GetObjectBytes(bucket, key)
+	if err != nil {
+		return r, err
+	}
+	if body == nil {
+		return r, fmt.Errorf("release %s not found at s3://%s/%s", id, bucket, key)
+	}
+
+	if err := json.Unmarshal(body, &r); err != nil {
+		return r, fmt.Errorf("error parsing release s3://%s/%s: %s", bucket, key, err)
+	}
+
+	return r, nil
+}
+
+func (s3Helper S3Helper) writeRelease(bucket string, prefix string, r release) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(r); err != nil {
+		return err
+	}
+
+	key := objectKey(prefix, releaseKey(r.ID))
+	log.Printf("[DEBUG] Writing release. bucket=%s, key=%s, objects=%d", bucket, key, len(r.Objects))
+
+	return s3Helper.PutObjectBytes(bucket, key, buf.Bytes(), "application/json")
+}
+
+// listReleaseIds returns the ids of the releases of a site, the latest first.
+// Only the listing is read, not the manifests.
+func (s3Helper S3Helper) listReleaseIds(bucket string, prefix string) ([]string, error) {
+	var ids []string
+	err := s3Helper.WalkS3Objects(bucket, objectKey(prefix, releasesDir), func(page []*s3.Object) error {
+		for _, object := range page {
+			name := strings.TrimPrefix(aws.StringValue(object.Key), objectKey(prefix, releasesDir))
+			if strings.Contains(name, "/") || !strings.HasSuffix(name, ".json") {
+				continue
+			}
+			ids = append(ids, strings.TrimSuffix(name, ".json"))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+
+	return ids, nil
+}
+
+// listReleases returns the releases of a site, the latest first.
+func (s3Helper S3Helper) listReleases(bucket string, prefix string) ([]release, error) {
+	ids, err := s3Helper.listReleaseIds(bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	releases := make([]release, 0, len(ids))
+	for _, id := range ids {
+		r, err := s3Helper.readRelease(bucket, prefix, id)
+		if err != nil {
+			return nil, err
+		}
+		releases = append(releases, r)
+	}
+
+	return releases, nil
+}
+
+// expiredReleases returns the ids, sorted the latest first, of the releases
+// beyond the keep latest ones. The release in protected is never expired so a
+// configured rollback keeps working.
+func expiredReleases(ids []string, keep int, protected string) []string {
+	var expired []string
+	for i, id := range ids {
+		if i >= keep && id != protected {
+			expired = append(expired, id)
+		}
+	}
+
+	return expired
+}
+
+// pruneReleases deletes the manifests of the expired releases of a site.
+func (s3Helper S3Helper) pruneReleases(bucket string, prefix string, keep int, protected string) error {
+	ids, err := s3Helper.listReleaseIds(bucket, prefix)
+	if err != nil {
+		return err
+	}
+
+	expired := expiredReleases(ids, keep, protected)
+	if len(expired) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(expired))
+	for _, id := range expired {
+		keys = append(keys, objectKey(prefix, releaseKey(id)))
+	}
+
+	log.Printf("[INFO] Pruning releases. bucket=%s, prefix=%s, keep=%d, delete=%d", bucket, prefix, keep, len(keys))
+	_, err = s3Helper.DeleteObjects(bucket, keys)
+	return err
+}
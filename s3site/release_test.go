@@ -0,0 +1,92 @@
+package s3site
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewRelease(t *testing.T) {
+	objects := map[string]siteObject{
+		"static/app.js": {Key: "static/app.js", Checksum: "b", VersionId: "2"},
+		"index.html":    {Key: "index.html", Checksum: "a", VersionId: "1", TagsHash: "t"},
+	}
+	now := time.Date(2020, 10, 20, 12, 30, 15, 500, time.UTC)
+
+	r := newRelease(now, releaseSource{Path: "site.zip"}, objects)
+
+	if !strings.HasPrefix(r.ID, "20201020T123015.000000Z-") {
+		t.Errorf("Invalid release id: %s", r.ID)
+	}
+
+	if other := newRelease(now, releaseSource{}, nil); other.ID == r.ID {
+		t.Errorf("Releases at the same time share the id %s", r.ID)
+	}
+
+	if later := newRelease(now.Add(time.Millisecond), releaseSource{}, nil); later.ID <= r.ID {
+		t.Errorf("Release ids do not sort by time: %s, %s", r.ID, later.ID)
+	}
+
+	if len(r.Objects) != 2 || r.Objects[0].Key != "index.html" {
+		t.Errorf("Invalid release objects: %v", r.Objects)
+	}
+
+	restored := r.siteObjects()
+	if restored["index.html"] != objects["index.html"] || restored["static/app.js"] != objects["static/app.js"] {
+		t.Errorf("Invalid round trip: %v", restored)
+	}
+}
+
+func TestPlanRollback(t *testing.T) {
+	r := newRelease(time.Now(), releaseSource{}, map[string]siteObject{
+		"index.html":    {Key: "index.html", Checksum: "a", MetadataHash: "m", VersionId: "1"},
+		"static/v1.js":  {Key: "static/v1.js", Checksum: "b", MetadataHash: "m", VersionId: "2"},
+		"static/lib.js": {Key: "static/lib.js", Checksum: "c", MetadataHash: "m"},
+	})
+
+	current := map[string]siteObject{
+		"index.html":    {Key: "index.html", Checksum: "d", MetadataHash: "m", VersionId: "3"},
+		"static/v2.js":  {Key: "static/v2.js", Checksum: "e", MetadataHash: "m", VersionId: "4"},
+		"static/lib.js": {Key: "static/lib.js", Checksum: "c", MetadataHash: "m"},
+	}
+
+	objects, err := planRollback(r, current)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	changed, removed := diffObjects(current, objects)
+	if len(changed) != 2 || len(removed) != 1 || removed[0] != "static/v2.js" {
+		t.Errorf("Invalid rollback plan. changed=%v, removed=%v", changed, removed)
+	}
+
+	// Objects without a recorded version can only be kept, not restored
+	current["static/lib.js"] = siteObject{Key: "static/lib.js", Checksum: "f", MetadataHash: "m"}
+	if _, err := planRollback(r, current); err == nil || !strings.Contains(err.Error(), "static/lib.js") {
+		t.Errorf("Missing error for an unversioned object: %v", err)
+	}
+}
+
+func TestExpiredReleases(t *testing.T) {
+	ids := []string{"20201024T000000Z", "20201023T000000Z", "20201022T000000Z", "20201021T000000Z", "20201020T000000Z"}
+
+	cases := []struct {
+		keep      int
+		protected string
+		expected  []string
+	}{
+		{5, "", nil},
+		{10, "", nil},
+		{2, "", []string{"20201022T000000Z", "20201021T000000Z", "20201020T000000Z"}},
+		{2, "20201021T000000Z", []string{"20201022T000000Z", "20201020T000000Z"}},
+		{1, "20201024T000000Z", []string{"20201023T000000Z", "20201022T000000Z", "20201021T000000Z", "20201020T000000Z"}},
+	}
+
+	for _, c := range cases {
+		if expired := expiredReleases(ids, c.keep, c.protected); !reflect.DeepEqual(expired, c.expected) {
+			t.Errorf("Invalid expired releases for keep=%d, protected=%s. expected=%v, actual=%v",
+				c.keep, c.protected, c.expected, expired)
+		}
+	}
+}
@@ -2,9 +2,11 @@ package s3site
 
 import (
 	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/cloudfront"
 	"github.com/hashicorp/terraform/helper/schema"
 	"log"
+	"net/url"
 	"time"
 )
 
@@ -23,33 +25,88 @@ func resourceCloudfrontInvalidation() *schema.Resource {
 				Type:     schema.TypeString,
 				Required: true,
 			},
+			"object": {
+				Type:          schema.TypeSet,
+				Optional:      true,
+				ForceNew:      true,
+				Set:           siteObjectHash,
+				Elem:          invalidationObjectResource(),
+				ConflictsWith: []string{"files"},
+				Description: "The objects to invalidate, usually `s3site_site.site.object`. A new invalidation is " +
+					"created whenever the content or headers of an object change.",
+			},
+			"prefix": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				ForceNew:         true,
+				DiffSuppressFunc: suppressPrefixDiff,
+				ConflictsWith:    []string{"files"},
+				Description:      "Key prefix of the site the objects belong to, usually `s3site_site.site.prefix`.",
+			},
 			"files": {
-				Type:     schema.TypeMap,
-				Required: true,
-				ForceNew: true,
+				Type:          schema.TypeMap,
+				Optional:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"object"},
+				Deprecated: "keys with `%%` are not restored correctly and the site prefix is ignored, " +
+					"use `object` and `prefix` instead",
 			},
 		},
 	}
 }
 
+// invalidationObjectResource accepts the elements of the `object` set of
+// s3site_site as input.
+func invalidationObjectResource() *schema.Resource {
+	elem := siteObjectSchema().Elem.(*schema.Resource)
+	for _, s := range elem.Schema {
+		s.Computed = false
+		s.Optional = true
+	}
+	elem.Schema["key"].Optional = false
+	elem.Schema["key"].Required = true
+
+	return elem
+}
+
+// invalidationPaths returns the path of every object below prefix and of every
+// key of the legacy `files` map, percent-encoded as CloudFront expects.
+func invalidationPaths(objects map[string]siteObject, prefix string, files map[string]interface{}) []string {
+	var paths []string
+	for _, key := range sortedObjectKeys(objects) {
+		paths = append(paths, invalidationPath(objectKey(prefix, key)))
+	}
+
+	for key := range files {
+		paths = append(paths, invalidationPath(decodeKey(key)))
+	}
+
+	return paths
+}
+
+// invalidationPath escapes the segments of the path of the object at key.
+func invalidationPath(key string) string {
+	return (&url.URL{Path: "/" + key}).EscapedPath()
+}
+
 func resourceCloudfrontInvalidationCreate(data *schema.ResourceData, meta interface{}) error {
 	distributionId := data.Get("cloudfront_distribution_id").(string)
 	files := data.Get("files").(map[string]interface{})
+	objects := expandSiteObjects(data.Get("object"))
+	paths := invalidationPaths(objects, data.Get("prefix").(string), files)
 
 	m := meta.(*Meta)
 	svc := cloudfront.New(m.Session)
 
-	timestamp := time.Now().String()
-	quantity := int64(len(files))
-
-	var items []*string
-
-	for key, _ := range files {
-		decodedKey := fmt.Sprintf("/%s", decodeKey(key))
-		items = append(items, &decodedKey)
+	if len(paths) == 0 {
+		return fmt.Errorf("one of `object` or `files` must contain at least one object")
 	}
 
-	log.Printf("[INFO] Creating invalidation request. paths=%d", len(files))
+	timestamp := time.Now().String()
+	quantity := int64(len(paths))
+	items := aws.StringSlice(paths)
+
+	log.Printf("[INFO] Creating invalidation request. paths=%d", len(paths))
 
 	input := &cloudfront.CreateInvalidationInput{
 		DistributionId: &distributionId,
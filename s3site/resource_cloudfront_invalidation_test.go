@@ -0,0 +1,51 @@
+package s3site
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func TestInvalidationPaths(t *testing.T) {
+	objects := map[string]siteObject{
+		"index.html":         {Key: "index.html"},
+		"static/100%%.css":   {Key: "static/100%%.css"},
+		"docs/über uns.html": {Key: "docs/über uns.html"},
+	}
+
+	cases := []struct {
+		prefix   string
+		files    map[string]interface{}
+		expected []string
+	}{
+		{"", nil, []string{"/docs/%C3%BCber%20uns.html", "/index.html", "/static/100%25%25.css"}},
+		{"/app/", nil, []string{"/app/docs/%C3%BCber%20uns.html", "/app/index.html", "/app/static/100%25%25.css"}},
+		{"", map[string]interface{}{"legacy%%js": "a"}, []string{"/docs/%C3%BCber%20uns.html", "/index.html", "/static/100%25%25.css", "/legacy.js"}},
+	}
+
+	for _, c := range cases {
+		paths := invalidationPaths(objects, c.prefix, c.files)
+		if !reflect.DeepEqual(paths, c.expected) {
+			t.Errorf("Invalid paths for prefix %q. expected=%v, actual=%v", c.prefix, c.expected, paths)
+		}
+	}
+}
+
+func TestInvalidationObjectFromSite(t *testing.T) {
+	raw := map[string]interface{}{
+		"cloudfront_distribution_id": "E123",
+		"prefix":                     "app",
+		"object": []interface{}{
+			map[string]interface{}{"key": "index.html", "etag": "\"a\"", "checksum": "a", "size": 1, "version_id": "v1"},
+		},
+	}
+
+	data := schema.TestResourceDataRaw(t, resourceCloudfrontInvalidation().Schema, raw)
+	objects := expandSiteObjects(data.Get("object"))
+
+	paths := invalidationPaths(objects, data.Get("prefix").(string), nil)
+	if !reflect.DeepEqual(paths, []string{"/app/index.html"}) {
+		t.Errorf("Invalid paths: %v", paths)
+	}
+}
@@ -6,20 +6,26 @@ import (
 	"log"
 	"mime"
 	"net/http"
+	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
 )
 
 // Part size for multipart uploads
 const partSize int64 = 1024 * 1024 * 5
 
 func resourceSite() *schema.Resource {
-	return &schema.Resource{
+	resource := &schema.Resource{
 		Create: resourceSiteCreate,
 		Read:   resourceSiteRead,
 		Update: resourceSiteUpdate,
@@ -30,59 +36,449 @@ func resourceSite() *schema.Resource {
 
 		CustomizeDiff: customizeDiff,
 
+		SchemaVersion: 2,
+		StateUpgraders: []schema.StateUpgrader{
+			{
+				Version: 0,
+				Type:    resourceSiteV0().CoreConfigSchema().ImpliedType(),
+				Upgrade: resourceSiteStateUpgradeV0,
+			},
+			{
+				Version: 1,
+				Type:    resourceSiteV1().CoreConfigSchema().ImpliedType(),
+				Upgrade: resourceSiteStateUpgradeV1,
+			},
+		},
+
 		Schema: map[string]*schema.Schema{
 			"bucket": {
 				Type:     schema.TypeString,
 				Required: true,
 			},
+			"prefix": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				ForceNew:         true,
+				DiffSuppressFunc: suppressPrefixDiff,
+				Description:      "Key prefix the site is deployed under. Only objects below the prefix are managed.",
+			},
 			"path": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"source_dir"},
+				Description:   "Path to the archive containing the site.",
+			},
+			"archive_format": {
 				Type:     schema.TypeString,
-				Required: true,
+				Optional: true,
+				Description: "Format of the archive at `path`. Detected from the file name or content when not set " +
+					"or empty, as exported by the data sources when they could not detect it.",
+				ValidateFunc: validation.StringInSlice(append([]string{""}, archiveFormats...), false),
+			},
+			"max_extracted_bytes": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Description:  "Maximum total size in bytes of the files extracted from `path`, 2 GiB when not set.",
+				ValidateFunc: validation.IntAtLeast(0),
 			},
+			"max_extracted_files": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Description:  "Maximum number of files extracted from `path`, 100000 when not set.",
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"max_compression_ratio": {
+				Type:     schema.TypeInt,
+				Optional: true,
+				Description: "Maximum ratio of the extracted size to the size of `path`, and of a zip entry to its " +
+					"compressed size, 200 when not set.",
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"source_dir": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"path"},
+				Description:   "Path to a local directory containing the site, used instead of `path`. It must not contain symbolic links.",
+			},
+			"signature_path": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Path to a detached signature of the archive at `path`, verified against `public_keys`.",
+			},
+			"object": siteObjectSchema(),
 			"files": {
 				Type:     schema.TypeMap,
 				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+				Description: "Deprecated, use `object` instead. Checksum of every object keyed by the object key with " +
+					"every `.` replaced by `%%`, as expected by the deprecated `files` of `s3site_cloudfront_invalidation`.",
+			},
+			"include": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString, ValidateFunc: validateGlob},
+				Description: "Glob patterns of the keys to deploy. All keys are deployed when empty.",
 			},
 			"exclude": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString, ValidateFunc: validateGlob},
+				Description: "Glob patterns of the keys to leave out, evaluated in order. " +
+					"A pattern starting with `!` keeps keys excluded by an earlier pattern.",
+			},
+			"entry_points": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString, ValidateFunc: validateGlob},
+				Description: "Glob patterns of the keys visitors enter the site through, `**/*.html` when empty. " +
+					"They are uploaded after all other objects, and removed objects are deleted last.",
+			},
+			"object_rule":   objectRuleSchema(),
+			"acl":           objectACLSchema(),
+			"storage_class": objectStorageClassSchema(),
+			"tags":          objectTagsSchema(),
+			"server_side_encryption": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "Server-side encryption of the uploaded objects, `AES256` or `aws:kms`.",
+				ValidateFunc: validation.StringInSlice([]string{s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms}, false),
+			},
+			"kms_key_id": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "KMS key used when `server_side_encryption` is `aws:kms`. Defaults to the AWS managed key.",
+			},
+			"bucket_key_enabled": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Use an S3 Bucket Key for `aws:kms` encryption.",
+			},
+			"checksum_algorithm": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Description: "How content changes are detected. `ETAG` (default) compares the S3 ETag with one computed " +
+					"for the upload part size. `SHA256` and `CRC32C` compare a checksum of the whole file recorded in " +
+					"`x-amz-meta-s3site-sha256` or `x-amz-meta-s3site-crc32c` at upload. Changing it uploads every object once.",
+				ValidateFunc: validation.StringInSlice(checksumAlgorithms, false),
+			},
+			"retain_removed_for": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Description: "How long objects removed from the site are kept in the bucket, e.g. `168h`, so pages " +
+					"still open on an older release can load them. Expired objects are deleted on a later apply.",
+				ValidateFunc: validateDuration,
+			},
+			"retain_releases": {
+				Type:     schema.TypeInt,
+				Optional: true,
+				Description: "Number of previous deployments whose removed objects are kept in the bucket. When combined " +
+					"with `retain_removed_for`, objects are deleted once both have passed.",
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"retained": retainedSchema(),
+			"max_delete_count": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Description:  "Maximum number of objects a single apply may remove from the site. Not enforced when 0.",
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"max_delete_percent": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Description:  "Maximum share of the objects, in percent, a single apply may remove from the site. Not enforced when 0.",
+				ValidateFunc: validation.IntBetween(0, 100),
+			},
+			"ownership": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Description: "Mark uploaded objects as owned by this site with `x-amz-meta-s3site-owner` (`METADATA`) or an " +
+					"`s3site-owner` tag (`TAG`). Objects below `prefix` without the marker are then ignored, so objects " +
+					"written by other tools are never deleted. Every object is managed when not set.",
+				ValidateFunc: validation.StringInSlice(ownershipModes, false),
+			},
+			"adopt_existing": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Description: "Manage objects below `prefix` that carry no ownership marker, marking them on the next apply " +
+					"or deleting them when they are no longer part of the site. Objects of other sites are never adopted.",
+			},
+			"lock_timeout": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Description: "Lease of the lock taken at `.s3site/lock.json` below `prefix` while objects are changed, " +
+					"`15m` by default. The lease is renewed during the apply; a lock left behind by a crashed apply " +
+					"expires after it and is taken over. To force unlock, delete the lock object, e.g. " +
+					"`aws s3 rm s3://<bucket>/<prefix>/.s3site/lock.json`. At least `30s`.",
+				ValidateFunc: validateLockTimeout,
+			},
+			"disable_lock": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Change objects without taking the lock, for storage without conditional writes.",
+			},
+			"force_destroy_unmanaged": {
+				Type:          schema.TypeBool,
+				Optional:      true,
+				ConflictsWith: []string{"retain_on_destroy"},
+				Description: "Delete every object below `prefix` on destroy, including objects this resource did not " +
+					"deploy. Objects of other sites deployed below `prefix` are kept.",
+			},
+			"retain_on_destroy": {
+				Type:          schema.TypeBool,
+				Optional:      true,
+				ConflictsWith: []string{"force_destroy_unmanaged"},
+				Description:   "Leave all objects in the bucket on destroy and only remove the site from state.",
+			},
+			"allow_large_delete": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Remove objects even when `max_delete_count` or `max_delete_percent` is exceeded.",
+			},
+			"rollback_to": {
 				Type:     schema.TypeString,
 				Optional: true,
+				Description: "Id of a release to restore instead of deploying `path` or `source_dir`. Changed objects are " +
+					"copied back from the versions recorded in the release, which requires a versioned bucket.",
+			},
+			"keep_releases": {
+				Type:     schema.TypeInt,
+				Optional: true,
+				Description: "Number of release manifests kept for `rollback_to` and `s3site_releases`, 20 when not set. " +
+					"Older ones are deleted after each release; the release in `rollback_to` is always kept. At least 1.",
+				ValidateFunc: validation.IntAtLeast(1),
+			},
+			"release_id": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Id of the release deployed by the last apply that changed objects.",
+			},
+			"parallelism": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Description:  "Number of concurrent object uploads. Defaults to the provider `parallelism`.",
+				ValidateFunc: validation.IntAtLeast(1),
 			},
 		},
 	}
+
+	for key, s := range planSummarySchema() {
+		resource.Schema[key] = s
+	}
+	for key, s := range artifactCheckSchema() {
+		resource.Schema[key] = s
+	}
+
+	return resource
+}
+
+// suppressPrefixDiff ignores prefix changes that only add or remove slashes,
+// e.g. between an imported `app` and a configured `app/`.
+func suppressPrefixDiff(k, old, new string, d *schema.ResourceData) bool {
+	return normalizePrefix(old) == normalizePrefix(new)
 }
 
 func customizeDiff(diff *schema.ResourceDiff, v interface{}) error {
-	path := diff.Get("path").(string)
-	exclude := diff.Get("exclude").(string)
+	m := v.(*Meta)
+	bucket := diff.Get("bucket").(string)
+	prefix := diff.Get("prefix").(string)
+
+	if serverSideEncryption := diff.Get("server_side_encryption").(string); serverSideEncryption != s3.ServerSideEncryptionAwsKms {
+		if diff.Get("kms_key_id").(string) != "" {
+			return fmt.Errorf("`kms_key_id` requires `server_side_encryption` to be %q", s3.ServerSideEncryptionAwsKms)
+		}
+		if diff.Get("bucket_key_enabled").(bool) {
+			return fmt.Errorf("`bucket_key_enabled` requires `server_side_encryption` to be %q", s3.ServerSideEncryptionAwsKms)
+		}
+	}
 
-	fileMap := make(map[string]interface{})
+	retention, err := siteRetention(diff)
+	if err != nil {
+		return err
+	}
 
-	if localFiles, err := extractArchive(path); err != nil {
+	check := siteArtifactCheck(diff)
+	if err := check.validate("signature_path"); err != nil {
 		return err
+	}
+	if check.enabled() && diff.Get("source_dir").(string) != "" {
+		return fmt.Errorf("`expected_sha256` and `signature_path` verify the archive at `path` and cannot be used with `source_dir`")
+	}
+
+	oldObjects := expandSiteObjects(diff.Get("object"))
+
+	var objects map[string]siteObject
+	if rollbackTo := diff.Get("rollback_to").(string); rollbackTo != "" {
+		r, err := m.S3Helper.readRelease(bucket, prefix, rollbackTo)
+		if err != nil {
+			return err
+		}
+
+		objects, err = planRollback(r, oldObjects)
+		if err != nil {
+			return err
+		}
 	} else {
-		for _, localFile := range localFiles {
-			hash, err := localFile.getMd5Checksum()
+		objects, err = planSite(diff, m, oldObjects)
+		if err != nil {
+			return err
+		}
+	}
 
-			if err != nil {
-				return err
+	setSiteObjects(diff.SetNew, objects)
+
+	changed, removedKeys := diffObjects(oldObjects, objects)
+	if err := siteDeleteGuard(diff).check(removedKeys, len(oldObjects)); err != nil {
+		return err
+	}
+
+	// Every apply that changes objects records a new release. The summary
+	// stays in state as planned until the next change.
+	objectsChange := len(changed) > 0 || len(removedKeys) > 0 || len(diffTags(oldObjects, objects, changed)) > 0
+	if objectsChange {
+		diff.SetNewComputed("release_id")
+	}
+	if objectsChange || diff.Id() == "" {
+		summarizeChanges(oldObjects, objects).set(diff.SetNew)
+	}
+
+	// The time objects are removed at and which retained objects expire are
+	// only known at apply, so the retained objects are left to the apply
+	// whenever they may change
+	oldRetained := expandRetainedObjects(diff.Get("retained"))
+	retained, _ := retainObjects(oldRetained, nil, objects, retention, time.Now())
+	if len(removedKeys) > 0 || (len(oldRetained) > 0 && objectsChange) ||
+		!reflect.DeepEqual(flattenRetainedObjects(oldRetained), flattenRetainedObjects(retained)) {
+		diff.SetNewComputed("retained")
+	}
+
+	return nil
+}
+
+// planSite returns the objects of the local site as they will be uploaded.
+func planSite(diff *schema.ResourceDiff, m *Meta, oldObjects map[string]siteObject) (map[string]siteObject, error) {
+	path := diff.Get("path").(string)
+	sourceDir := diff.Get("source_dir").(string)
+	archiveFormat := diff.Get("archive_format").(string)
+	filter := newKeyFilter(diff.Get("include").([]interface{}), diff.Get("exclude").([]interface{}))
+
+	// Nothing is planned from an archive that fails its checks
+	if err := siteArtifactCheck(diff).verify(path); err != nil {
+		return nil, err
+	}
+
+	root, cleanup, err := openSite(m.WorkDir, path, sourceDir, archiveFormat, siteExtractLimits(diff))
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	localFiles, err := listDirectory(root)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfoMap := make(map[string]fileInfo)
+	for _, localFile := range localFiles {
+		if isControlKey(localFile.RelativePath) {
+			log.Printf("[WARN] Skipping file in the reserved %s directory. key=%s", controlDir, localFile.RelativePath)
+			continue
+		}
+		if !filter.match(localFile.RelativePath) {
+			log.Printf("[DEBUG] Filtering out file. key=%s", localFile.RelativePath)
+			continue
+		}
+		fileInfoMap[localFile.RelativePath] = localFile
+	}
+
+	objects := make(map[string]siteObject)
+	for key, fi := range decorateSite(fileInfoMap, diff) {
+		checksum, err := fi.getChecksum(fi.ChecksumAlgorithm)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(fi.Tags) > maxObjectTags {
+			return nil, fmt.Errorf("%s has %d tags, S3 allows at most %d per object", key, len(fi.Tags), maxObjectTags)
+		}
+
+		log.Printf("[DEBUG] Read file. key=%s, value=%s", key, checksum)
+		object := siteObject{
+			Key:          key,
+			Checksum:     checksum,
+			Size:         fi.FileInfo.Size(),
+			ContentType:  fi.ContentType,
+			CacheControl: fi.CacheControl,
+			MetadataHash: fi.metadataFingerprint(),
+			TagsHash:     tagsFingerprint(fi.Tags),
+		}
+
+		// The ETag is predictable only for the ETag algorithm
+		if fi.ChecksumAlgorithm == checksumAlgorithmETag {
+			object.ETag = checksum
+		}
+
+		// ETag and version are only known after an upload, keep them for unchanged objects
+		if oldObject, ok := oldObjects[key]; ok && oldObject.Checksum == object.Checksum {
+			object.ETag = oldObject.ETag
+
+			if oldObject.MetadataHash == object.MetadataHash {
+				object.VersionId = oldObject.VersionId
 			}
+		}
+
+		objects[key] = object
+	}
 
-			key := encodeKey(localFile.RelativePath)
+	return objects, nil
+}
 
-			log.Printf("[DEBUG] Read file. key=%s, value=%s", key, hash)
-			fileMap[key] = hash
+// openSite returns the local directory holding the site files. A source
+// directory is used as is; an archive is extracted into a new workspace below
+// workDir which the returned cleanup function removes again.
+func openSite(workDir string, path string, sourceDir string, archiveFormat string, limits extractLimits) (string, func(), error) {
+	if path == "" && sourceDir == "" {
+		return "", nil, fmt.Errorf("one of `path` or `source_dir` must be set")
+	}
+
+	if sourceDir != "" {
+		if info, err := os.Stat(sourceDir); err != nil {
+			return "", nil, err
+		} else if !info.IsDir() {
+			return "", nil, fmt.Errorf("source_dir %s is not a directory", sourceDir)
 		}
+
+		return sourceDir, func() {}, nil
 	}
 
-	fileMap = filterMap(fileMap, exclude)
+	workspace, cleanup, err := newWorkspace(workDir, "site")
+	if err != nil {
+		return "", nil, err
+	}
 
-	diff.SetNew("files", fileMap)
+	log.Printf("[DEBUG] Extracting archive. path=%s, workspace=%s", path, workspace)
+	if err := openArchive(path, archiveFormat, workspace, limits); err != nil {
+		cleanup()
+		return "", nil, err
+	}
 
-	return nil
+	return workspace, cleanup, nil
+}
+
+// openSiteData calls openSite with the site configuration of a resource. The
+// archive is verified again as it may have changed since the plan.
+func openSiteData(data *schema.ResourceData, m *Meta) (string, func(), error) {
+	if err := siteArtifactCheck(data).verify(data.Get("path").(string)); err != nil {
+		return "", nil, err
+	}
+
+	return openSite(m.WorkDir, data.Get("path").(string), data.Get("source_dir").(string), data.Get("archive_format").(string),
+		siteExtractLimits(data))
 }
 
 func importState(data *schema.ResourceData, meta interface{}) ([]*schema.ResourceData, error) {
-	data.Set("bucket", data.Id())
+	bucket, prefix := parseSiteId(data.Id())
+	data.Set("bucket", bucket)
+	data.Set("prefix", prefix)
 
 	err := resourceSiteRead(data, meta)
 	if err != nil {
@@ -95,19 +491,109 @@ func importState(data *schema.ResourceData, meta interface{}) ([]*schema.Resourc
 func resourceSiteCreate(data *schema.ResourceData, meta interface{}) error {
 	m := meta.(*Meta)
 	bucket := data.Get("bucket").(string)
-	exclude := data.Get("exclude").(string)
-	keyChecksumMap := data.Get("files").(map[string]interface{})
+	prefix := data.Get("prefix").(string)
+
+	lock, err := lockSite(data, m)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	data.SetId(siteId(bucket, prefix))
+
+	objects := expandSiteObjects(data.Get("object"))
+
+	versions, err := publishSite(data, m, lock, objects, nil)
+	setVersions(objects, versions)
+	setSiteObjects(data.Set, objects)
+	if err != nil {
+		return err
+	}
+
+	if err := lock.err(); err != nil {
+		return err
+	}
+
+	return recordRelease(data, m, objects)
+}
+
+// publishSite puts objects in place, copying them back from their recorded
+// versions when rolling back and uploading them from the local site
+// otherwise. Objects whose only change is their tags are retagged. Losing the
+// lock stops the changes still in flight.
+func publishSite(data *schema.ResourceData, m *Meta, lock *siteLock, objects map[string]siteObject, objectsToTag map[string]siteObject) (map[string]string, error) {
+	bucket := data.Get("bucket").(string)
+	prefix := data.Get("prefix").(string)
+	ctx := lock.context()
+
+	if err := lock.err(); err != nil {
+		return nil, err
+	}
+
+	if data.Get("rollback_to").(string) != "" {
+		// A copy carries the tags of the recorded version along
+		objectsToRestore := make(map[string]siteObject)
+		for key, object := range objects {
+			objectsToRestore[key] = object
+		}
+		for key, object := range objectsToTag {
+			objectsToRestore[key] = object
+		}
+
+		return restoreSite(ctx, m.S3Helper, objectsToRestore, bucket, prefix, siteEntryPoints(data), parallelism(data, m))
+	}
+
+	root, cleanup, err := openSiteData(data, m)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	fileInfoMapD := decorateSite(convertMap(objects, root), data)
+
+	versions, err := deploySite(ctx, m.S3Helper, fileInfoMapD, bucket, prefix, siteEntryPoints(data), parallelism(data, m))
+	if err != nil {
+		return versions, err
+	}
+
+	if len(objectsToTag) > 0 {
+		filesToTagFileMapD := decorateSite(convertMap(objectsToTag, root), data)
+
+		if err := m.S3Helper.PutS3ObjectTags(ctx, filesToTagFileMapD, bucket, prefix, parallelism(data, m)); err != nil {
+			return versions, err
+		}
+	}
+
+	return versions, nil
+}
+
+// recordRelease writes the manifest of the deployed objects to the bucket.
+func recordRelease(data *schema.ResourceData, m *Meta, objects map[string]siteObject) error {
+	bucket := data.Get("bucket").(string)
+	prefix := data.Get("prefix").(string)
 
-	data.SetId(bucket)
+	source, err := siteSource(data)
+	if err != nil {
+		return err
+	}
 
-	fileMap := filterMap(keyChecksumMap, exclude)
+	r := newRelease(time.Now(), source, objects)
+	if err := m.S3Helper.writeRelease(bucket, prefix, r); err != nil {
+		return err
+	}
 
-	fileInfoMap := convertMap(fileMap)
+	log.Printf("[INFO] Recorded release. id=%s, objects=%d", r.ID, len(r.Objects))
+	data.Set("release_id", r.ID)
 
-	fileInfoMapD := decorateMap(fileInfoMap)
+	// keep_releases is at least 1 when set
+	keep := defaultKeepReleases
+	if v := data.Get("keep_releases").(int); v > 0 {
+		keep = v
+	}
 
-	if bulkUploadErr := m.S3Helper.BulkUploadS3Objects(fileInfoMapD, bucket); bulkUploadErr != nil {
-		return bulkUploadErr
+	// Releases left over by a failed prune are removed by a later apply
+	if err := m.S3Helper.pruneReleases(bucket, prefix, keep, data.Get("rollback_to").(string)); err != nil {
+		log.Printf("[WARN] Unable to prune releases. bucket=%s, prefix=%s, err=%s", bucket, prefix, err)
 	}
 
 	return nil
@@ -116,10 +602,27 @@ func resourceSiteCreate(data *schema.ResourceData, meta interface{}) error {
 func resourceSiteRead(data *schema.ResourceData, meta interface{}) error {
 	m := meta.(*Meta)
 	bucket := data.Get("bucket").(string)
-	exclude := data.Get("exclude").(string)
+	prefix := data.Get("prefix").(string)
+	filter := newKeyFilter(data.Get("include").([]interface{}), data.Get("exclude").([]interface{}))
+	checksumAlgorithm := siteChecksumAlgorithm(data)
+	trackTags := siteTagsTracked(data)
+	owner := siteOwnership(data)
+	rules := siteObjectRules(data)
+
+	log.Printf("[INFO] Reading bucket. bucket=%s, prefix=%s", bucket, prefix)
+	objects := make(map[string]siteObject)
+	err := m.S3Helper.WalkS3Objects(bucket, prefix, func(page []*s3.Object) error {
+		for _, bucketFile := range page {
+			key := strings.TrimPrefix(*bucketFile.Key, normalizePrefix(prefix))
+			objects[key] = siteObject{
+				Key:  key,
+				ETag: cleanS3ETag(aws.StringValue(bucketFile.ETag)),
+				Size: aws.Int64Value(bucketFile.Size),
+			}
+		}
 
-	log.Printf("[INFO] Reading bucket. bucket=%s", bucket)
-	listObjectResponse, err := m.S3Helper.ListS3Objects(bucket)
+		return nil
+	})
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
@@ -136,109 +639,431 @@ func resourceSiteRead(data *schema.ResourceData, meta interface{}) error {
 		}
 	}
 
-	data.SetId(bucket)
+	data.SetId(siteId(bucket, prefix))
 
-	fileMap := make(map[string]interface{})
-	for _, bucketFile := range listObjectResponse.Contents {
-		key := encodeKey(*bucketFile.Key)
-		fileMap[key] = cleanS3ETag(*bucketFile.ETag)
+	l, err := m.S3Helper.readLedger(bucket, prefix)
+	if err != nil {
+		return err
 	}
+	data.Set("retained", flattenRetainedObjects(l.Removed))
+
+	// Found before filtering as the filter may not match the control objects
+	nested := nestedSites(sortedObjectKeys(objects))
 
-	fileMap = filterMap(fileMap, exclude)
+	objects = filterObjects(objects, filter)
+
+	// Control objects, retained objects and other sites below the prefix are
+	// not part of the site
+	retainedKeySet := make(map[string]bool)
+	for _, key := range retainedKeys(l.Removed) {
+		retainedKeySet[key] = true
+	}
+	for key := range objects {
+		if isControlKey(key) || inNestedSite(key, nested) || retainedKeySet[key] {
+			delete(objects, key)
+		}
+	}
+
+	keys := make([]string, 0, len(objects))
+	for key := range objects {
+		keys = append(keys, objectKey(prefix, key))
+	}
+
+	err = m.S3Helper.HeadS3Objects(bucket, keys, parallelism(data, m), func(s3Key string, head *s3.HeadObjectOutput) {
+		key := strings.TrimPrefix(s3Key, normalizePrefix(prefix))
+		if owner.Mode == ownershipMetadata && !owner.owns(headMetadata(head, ownerKey)) {
+			log.Printf("[DEBUG] Ignoring object owned by %q. key=%s", headMetadata(head, ownerKey), key)
+			delete(objects, key)
+			return
+		}
+
+		object := objects[key]
+		object.ContentType = aws.StringValue(head.ContentType)
+		object.CacheControl = aws.StringValue(head.CacheControl)
+		object.VersionId = aws.StringValue(head.VersionId)
+		expires := applyObjectRules(fileInfo{RelativePath: key}, rules).Expires
+		object.MetadataHash = headFileInfoExpires(head, expires).metadataFingerprint()
+
+		object.Checksum = headMetadata(head, checksumMetadataKey(checksumAlgorithm))
+
+		// The ETag is not an MD5 under SSE-KMS, without a recorded hash it is the best guess
+		if object.Checksum == "" && checksumAlgorithm == checksumAlgorithmETag {
+			object.Checksum = object.ETag
+		}
+		objects[key] = object
+	})
+	if err != nil {
+		return err
+	}
+
+	// Tags take a request per object, only fetch them when they are managed
+	if trackTags {
+		err = m.S3Helper.GetS3ObjectTags(bucket, keys, parallelism(data, m), func(s3Key string, tags map[string]string) {
+			key := strings.TrimPrefix(s3Key, normalizePrefix(prefix))
+			if owner.Mode == ownershipTag && !owner.owns(tags[ownerKey]) {
+				log.Printf("[DEBUG] Ignoring object owned by %q. key=%s", tags[ownerKey], key)
+				delete(objects, key)
+				return
+			}
+
+			object, ok := objects[key]
+			if !ok {
+				return
+			}
+			object.TagsHash = tagsFingerprint(tags)
+			objects[key] = object
+		})
+		if err != nil {
+			return err
+		}
+	}
 
-	data.Set("files", fileMap)
+	setSiteObjects(data.Set, objects)
 
 	return nil
 }
 
-func convertMap(fileMap map[string]interface{}) map[string]fileInfo {
-	fileInfoMap := make(map[string]fileInfo)
-	for key, checksum := range fileMap {
-		fileInfoMap[key] = convertKeyPair(key, checksum)
+// parallelism returns the upload concurrency of the site, falling back to the
+// provider default when the resource does not set one.
+func parallelism(data *schema.ResourceData, m *Meta) int {
+	if v, ok := data.GetOk("parallelism"); ok {
+		return v.(int)
 	}
 
-	return fileInfoMap
+	return m.Parallelism
 }
 
-func convertKeyPair(key string, value interface{}) fileInfo {
-	decodedKey := decodeKey(key)
-	return fileInfo{
-		RelativePath: decodedKey,
-		Hash:         value.(string),
-		FullPath:     fmt.Sprintf("%s/site/%s", tempDir, decodedKey),
+func convertMap(objects map[string]siteObject, root string) map[string]fileInfo {
+	fileInfoMap := make(map[string]fileInfo)
+	for key, object := range objects {
+		fileInfoMap[key] = fileInfo{
+			RelativePath: key,
+			Hash:         object.Checksum,
+			FullPath:     filepath.Join(root, filepath.FromSlash(key)),
+		}
 	}
+
+	return fileInfoMap
 }
 
 func resourceSiteUpdate(data *schema.ResourceData, meta interface{}) error {
 	m := meta.(*Meta)
 	bucket := data.Get("bucket").(string)
+	prefix := data.Get("prefix").(string)
 
-	oldFiles, newFiles := data.GetChange("files")
+	retention, err := siteRetention(data)
+	if err != nil {
+		return err
+	}
 
-	oldFileMap := oldFiles.(map[string]interface{})
-	newFileMap := newFiles.(map[string]interface{})
+	lock, err := lockSite(data, m)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	oldValue, newValue := data.GetChange("object")
+
+	oldObjects := expandSiteObjects(oldValue)
+	newObjects := expandSiteObjects(newValue)
 
-	filesToPutMap := make(map[string]interface{})
-	var filesToDelete []string
+	objectsToPut, removedKeys := diffObjects(oldObjects, newObjects)
+	objectsToTag := diffTags(oldObjects, newObjects, objectsToPut)
 
-	// Need to put these files regardless if they are new or updated
-	for key, value := range newFileMap {
-		filesToPutMap[key] = value
+	// Checked again since the plan may be stale or applied without a review
+	if err := siteDeleteGuard(data).check(removedKeys, len(oldObjects)); err != nil {
+		return err
 	}
 
-	// If the file doesn't exists anymore it needs to be deleted
-	for key, value := range oldFileMap {
-		if _, ok := newFileMap[key]; !ok {
-			f := convertKeyPair(key, value)
-			filesToDelete = append(filesToDelete, f.RelativePath)
+	log.Printf("[INFO] Updating site. bucket=%s, prefix=%s, objects=%d, put=%d, tag=%d, remove=%d",
+		bucket, prefix, len(newObjects), len(objectsToPut), len(objectsToTag), len(removedKeys))
+
+	if len(objectsToPut) > 0 || len(objectsToTag) > 0 {
+		versions, err := publishSite(data, m, lock, objectsToPut, objectsToTag)
+		setVersions(newObjects, versions)
+		setSiteObjects(data.Set, newObjects)
+		if err != nil {
+			return err
 		}
 	}
 
-	filesToPutFileMap := convertMap(filesToPutMap)
+	if err := lock.err(); err != nil {
+		return err
+	}
 
-	filesToPutFileMapD := decorateMap(filesToPutFileMap)
+	// The release is complete once its objects are in place
+	if len(objectsToPut) > 0 || len(objectsToTag) > 0 || len(removedKeys) > 0 {
+		if err := recordRelease(data, m, newObjects); err != nil {
+			return err
+		}
+	}
 
-	if err := m.S3Helper.BulkUploadS3Objects(filesToPutFileMapD, bucket); err != nil {
+	// The ledger in the bucket is authoritative, state may be outdated
+	l, err := m.S3Helper.readLedger(bucket, prefix)
+	if err != nil {
 		return err
 	}
 
-	if err := m.S3Helper.DeleteObjects(bucket, filesToDelete); err != nil {
+	retained, expired := retainObjects(l.Removed, removedKeys, newObjects, retention, time.Now())
+
+	var keysToDelete []string
+	for _, object := range expired {
+		keysToDelete = append(keysToDelete, objectKey(prefix, object.Key))
+	}
+
+	log.Printf("[INFO] Removing objects. bucket=%s, prefix=%s, retain=%d, delete=%d", bucket, prefix, len(retained), len(keysToDelete))
+
+	// Without the lock another apply may have changed the ledger read above
+	if err := lock.err(); err != nil {
 		return err
 	}
 
-	return nil
+	var errors error
+	if deleted, err := m.S3Helper.DeleteObjects(bucket, keysToDelete); err != nil {
+		errors = multierror.Append(errors, err)
+
+		// Objects that could not be deleted stay in the ledger so a later apply retries them
+		deletedKeys := make(map[string]bool)
+		for _, s3Key := range deleted {
+			deletedKeys[s3Key] = true
+		}
+		for _, object := range expired {
+			if !deletedKeys[objectKey(prefix, object.Key)] {
+				retained = append(retained, object)
+			}
+		}
+	}
+
+	if err := lock.err(); err != nil {
+		return multierror.Append(errors, err)
+	}
+
+	if len(retained) > 0 || len(l.Removed) > 0 {
+		if err := m.S3Helper.writeLedger(bucket, prefix, ledger{Removed: retained}); err != nil {
+			errors = multierror.Append(errors, err)
+		}
+	}
+
+	data.Set("retained", flattenRetainedObjects(retained))
+
+	return errors
 }
 
 func resourceSiteDelete(data *schema.ResourceData, meta interface{}) error {
 	m := meta.(*Meta)
 	bucket := data.Get("bucket").(string)
+	prefix := data.Get("prefix").(string)
+
+	if data.Get("retain_on_destroy").(bool) {
+		log.Printf("[INFO] Retaining site objects on destroy. bucket=%s, prefix=%s", bucket, prefix)
+		return nil
+	}
 
-	err := m.S3Helper.DeleteAllObjects(bucket)
+	lock, err := lockSite(data, m)
 	if err != nil {
 		return err
 	}
+	defer lock.release()
 
-	return nil
+	if data.Get("force_destroy_unmanaged").(bool) {
+		return deleteUnmanaged(m, lock, bucket, prefix)
+	}
+
+	objects := expandSiteObjects(data.Get("object"))
+
+	// Without ownership, state holds every object below the prefix, so only
+	// the ones a release of this site deployed are deleted
+	var releases []release
+	owned := siteOwnership(data).Mode != ""
+	if !owned && len(objects) > 0 {
+		releases, err = m.S3Helper.listReleases(bucket, prefix)
+		if err != nil {
+			return err
+		}
+		if len(releases) == 0 {
+			return fmt.Errorf("no release of the site is recorded below s3://%s/%s, so the objects it deployed are "+
+				"unknown. Set `ownership`, `force_destroy_unmanaged` or `retain_on_destroy` to destroy it",
+				bucket, normalizePrefix(prefix))
+		}
+	}
+
+	l, err := m.S3Helper.readLedger(bucket, prefix)
+	if err != nil {
+		return err
+	}
+
+	keys := managedDestroyKeys(objects, releases, l.Removed, owned)
+
+	s3Keys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		s3Keys = append(s3Keys, objectKey(prefix, key))
+	}
+
+	if err := lock.err(); err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] Deleting site objects. bucket=%s, prefix=%s, objects=%d", bucket, prefix, len(s3Keys))
+	if _, err := m.S3Helper.DeleteObjects(bucket, s3Keys); err != nil {
+		return err
+	}
+
+	if err := lock.err(); err != nil {
+		return err
+	}
+
+	// The lock is still held, its release deletes it
+	return m.S3Helper.DeleteAllObjects(bucket, objectKey(prefix, controlDir), objectKey(prefix, lockKey))
 }
 
-func filterMap(fileMap map[string]interface{}, exclude string) map[string]interface{} {
-	if exclude == "" {
-		return fileMap
+// deleteUnmanaged deletes every object below prefix except the ones of other
+// sites nested below it and the lock, which its release deletes.
+func deleteUnmanaged(m *Meta, lock *siteLock, bucket string, prefix string) error {
+	var keys []string
+	err := m.S3Helper.WalkS3Objects(bucket, prefix, func(page []*s3.Object) error {
+		for _, object := range page {
+			keys = append(keys, strings.TrimPrefix(aws.StringValue(object.Key), normalizePrefix(prefix)))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	keys = unmanagedDestroyKeys(keys)
+	s3Keys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		s3Keys = append(s3Keys, objectKey(prefix, key))
+	}
+
+	if err := lock.err(); err != nil {
+		return err
 	}
 
-	filteredFileMap := make(map[string]interface{})
-	for key, value := range fileMap {
-		if strings.Contains(key, exclude) {
-			log.Printf("[DEBUG] Filtering out file. key=%s", key)
+	log.Printf("[INFO] Deleting all objects below prefix. bucket=%s, prefix=%s, objects=%d", bucket, prefix, len(s3Keys))
+	_, err = m.S3Helper.DeleteObjects(bucket, s3Keys)
+	return err
+}
+
+// managedDestroyKeys returns the keys, relative to the prefix, of the objects
+// a destroy deletes: the objects in state and the retained ones. Unless owned
+// limits state to the objects of the site, only objects in state that one of
+// the releases deployed are included.
+func managedDestroyKeys(objects map[string]siteObject, releases []release, retained []retainedObject, owned bool) []string {
+	deployed := make(map[string]bool)
+	for _, r := range releases {
+		for _, object := range r.Objects {
+			deployed[object.Key] = true
+		}
+	}
+
+	var keys []string
+	for _, key := range sortedObjectKeys(objects) {
+		if !owned && !deployed[key] {
+			log.Printf("[DEBUG] Keeping object no release deployed. key=%s", key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	return append(keys, retainedKeys(retained)...)
+}
+
+// unmanagedDestroyKeys returns the keys, relative to the prefix, a destroy
+// with `force_destroy_unmanaged` deletes: every key except the ones of other
+// sites nested below the prefix and the lock, which its release deletes.
+func unmanagedDestroyKeys(keys []string) []string {
+	nested := nestedSites(keys)
+
+	var destroyKeys []string
+	for _, key := range keys {
+		if inNestedSite(key, nested) || key == lockKey {
 			continue
 		}
-		filteredFileMap[key] = value
+		destroyKeys = append(destroyKeys, key)
+	}
+
+	return destroyKeys
+}
+
+// resourceGetter is implemented by both schema.ResourceData and
+// schema.ResourceDiff so settings can be read the same way at plan and apply.
+type resourceGetter interface {
+	Get(key string) interface{}
+}
+
+// siteObjectRules returns the resource level settings as a rule matching every
+// object, followed by the configured object rules.
+func siteObjectRules(d resourceGetter) []objectRule {
+	siteRule := objectRule{
+		Pattern:      "**",
+		ACL:          d.Get("acl").(string),
+		StorageClass: d.Get("storage_class").(string),
+		Tags:         expandStringMap(d.Get("tags")),
+	}
+
+	return append([]objectRule{siteRule}, expandObjectRules(d.Get("object_rule").([]interface{}))...)
+}
+
+// decorateSite applies decorateMap with the object rules of the resource and
+// adds the resource wide upload settings. The resource wide acl, storage class
+// and tags act as a rule matching every key, so object rules can override them.
+func decorateSite(fileInfoMap map[string]fileInfo, d resourceGetter) map[string]fileInfo {
+	fileInfoMapD := decorateMap(fileInfoMap, siteObjectRules(d))
+
+	serverSideEncryption := d.Get("server_side_encryption").(string)
+	kmsKeyId := d.Get("kms_key_id").(string)
+	bucketKeyEnabled := d.Get("bucket_key_enabled").(bool)
+	checksumAlgorithm := siteChecksumAlgorithm(d)
+	owner := siteOwnership(d)
+
+	for key, fi := range fileInfoMapD {
+		fi = owner.mark(fi)
+		fi.ServerSideEncryption = serverSideEncryption
+		fi.SSEKMSKeyId = kmsKeyId
+		fi.BucketKeyEnabled = bucketKeyEnabled
+		fi.ChecksumAlgorithm = checksumAlgorithm
+		fileInfoMapD[key] = fi
+	}
+
+	return fileInfoMapD
+}
+
+// siteTagsTracked reports whether object tags have to be read: tags are
+// configured or mark ownership, or objects in state still carry tags that
+// may need removing.
+func siteTagsTracked(d resourceGetter) bool {
+	if d.Get("ownership").(string) == ownershipTag || len(expandStringMap(d.Get("tags"))) > 0 {
+		return true
+	}
+
+	for _, rule := range expandObjectRules(d.Get("object_rule").([]interface{})) {
+		if len(rule.Tags) > 0 {
+			return true
+		}
+	}
+
+	for _, object := range expandSiteObjects(d.Get("object")) {
+		if object.TagsHash != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// siteChecksumAlgorithm returns the configured checksum algorithm, ETAG when
+// none is set.
+func siteChecksumAlgorithm(d resourceGetter) string {
+	if algorithm := d.Get("checksum_algorithm").(string); algorithm != "" {
+		return algorithm
 	}
 
-	return filteredFileMap
+	return checksumAlgorithmETag
 }
 
-func decorateMap(fileInfoMap map[string]fileInfo) map[string]fileInfo {
+func decorateMap(fileInfoMap map[string]fileInfo, rules []objectRule) map[string]fileInfo {
 	fileInfoMapD := make(map[string]fileInfo)
 	for key, fi := range fileInfoMap {
 		fileData, _ := ioutil.ReadFile(fi.FullPath)
@@ -253,18 +1078,13 @@ func decorateMap(fileInfoMap map[string]fileInfo) map[string]fileInfo {
 		if fi.ContentType == "" || strings.Contains(fi.ContentType, "javascript") {
 			fi.ContentType = http.DetectContentType(fileData)
 		}
-				
+
 		if strings.Contains(fi.ContentType, "gzip") && strings.Contains(filepath.Ext(fi.FullPath), ".js") {
 			fi.ContentEncoding = "gzip"
-			fi.ContentType = "application/javascript"			
+			fi.ContentType = "application/javascript"
 		}
 
-		if strings.HasSuffix(fi.FullPath, "index.html") {
-			fi.CacheControl = "no-cache, no-store, must-revalidate"
-			fi.Expires = "0"
-		}
-
-		fileInfoMapD[key] = fi
+		fileInfoMapD[key] = applyObjectRules(fi, rules)
 	}
 
 	return fileInfoMapD
@@ -0,0 +1,174 @@
+package s3site
+
+import (
+	"log"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// resourceSiteV0 is the schema of s3site_site before `exclude` became a list
+// of glob patterns. It is only used to decode states written by that version.
+func resourceSiteV0() *schema.Resource {
+	return &schema.Resource{
+		Schema: map[string]*schema.Schema{
+			"bucket": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"path": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"files": {
+				Type:     schema.TypeMap,
+				Computed: true,
+			},
+			"exclude": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+		},
+	}
+}
+
+// resourceSiteStateUpgradeV0 turns the single substring `exclude` into a list
+// of glob patterns matching the same keys: one for keys whose last segments
+// contain the substring and one for keys below directories containing it.
+func resourceSiteStateUpgradeV0(rawState map[string]interface{}, meta interface{}) (map[string]interface{}, error) {
+	exclude, _ := rawState["exclude"].(string)
+
+	if exclude == "" {
+		rawState["exclude"] = []interface{}{}
+	} else {
+		patterns := []interface{}{
+			"**/*" + decodeKey(exclude) + "*",
+			"**/*" + decodeKey(exclude) + "*/**",
+		}
+		log.Printf("[INFO] Upgrading exclude to glob patterns. exclude=%s, patterns=%v", exclude, patterns)
+		rawState["exclude"] = patterns
+	}
+
+	return rawState, nil
+}
+
+// resourceSiteV1 is the schema of s3site_site while objects were tracked in
+// the `files` and `metadata_hashes` maps keyed by `%%` encoded keys.
+func resourceSiteV1() *schema.Resource {
+	return &schema.Resource{
+		Schema: map[string]*schema.Schema{
+			"bucket": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"prefix": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"path": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"archive_format": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"source_dir": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"files": {
+				Type:     schema.TypeMap,
+				Computed: true,
+			},
+			"metadata_hashes": {
+				Type:     schema.TypeMap,
+				Computed: true,
+			},
+			"include": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"exclude": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"object_rule": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"pattern": {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+						"cache_control": {
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+						"content_type": {
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+						"content_encoding": {
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+						"content_disposition": {
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+						"content_language": {
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+						"metadata": {
+							Type:     schema.TypeMap,
+							Optional: true,
+							Elem:     &schema.Schema{Type: schema.TypeString},
+						},
+					},
+				},
+			},
+			"parallelism": {
+				Type:     schema.TypeInt,
+				Optional: true,
+			},
+		},
+	}
+}
+
+// resourceSiteStateUpgradeV1 moves the `files` and `metadata_hashes` maps into
+// the `object` set. Only the content hash and header fingerprint are known;
+// the next refresh fills in the other fields from the bucket. Since those two
+// values are what decides about uploads, nothing is deployed again. The
+// refresh also fingerprints the headers again, taking objects uploaded with an
+// Expires header before `s3site-expires` was recorded to carry the configured
+// value. `files` is rebuilt from the objects, keyed as before.
+func resourceSiteStateUpgradeV1(rawState map[string]interface{}, meta interface{}) (map[string]interface{}, error) {
+	files, _ := rawState["files"].(map[string]interface{})
+	metadataHashes, _ := rawState["metadata_hashes"].(map[string]interface{})
+
+	objects := make(map[string]siteObject)
+	for encodedKey, value := range files {
+		key := decodeKey(encodedKey)
+		etag, _ := value.(string)
+		metadataHash, _ := metadataHashes[encodedKey].(string)
+
+		objects[key] = siteObject{
+			Key:          key,
+			ETag:         etag,
+			Checksum:     etag,
+			MetadataHash: metadataHash,
+		}
+	}
+
+	log.Printf("[INFO] Upgrading files to objects. objects=%d", len(objects))
+
+	delete(rawState, "metadata_hashes")
+	rawState["object"] = flattenSiteObjects(objects)
+	rawState["files"] = flattenSiteFiles(objects)
+
+	return rawState, nil
+}
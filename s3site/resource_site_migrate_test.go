@@ -0,0 +1,79 @@
+package s3site
+
+import (
+	"testing"
+)
+
+func TestResourceSiteStateUpgradeV0(t *testing.T) {
+	state, err := resourceSiteStateUpgradeV0(map[string]interface{}{"exclude": "%%map"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exclude := state["exclude"].([]interface{})
+	if len(exclude) != 2 || exclude[0] != "**/*.map*" || exclude[1] != "**/*.map*/**" {
+		t.Errorf("Invalid upgraded exclude: %v", exclude)
+	}
+
+	// Keys containing the old substring stay excluded
+	state, _ = resourceSiteStateUpgradeV0(map[string]interface{}{"exclude": "static/js"}, nil)
+	filter := newKeyFilter(nil, state["exclude"].([]interface{}))
+	cases := map[string]bool{
+		"static/js":             false,
+		"static/js/app.js":      false,
+		"static/json/data.json": false,
+		"app/static/js/app.js":  false,
+		"static/css/app.css":    true,
+		"js/static/app.js":      true,
+	}
+	for key, expected := range cases {
+		if actual := filter.match(key); actual != expected {
+			t.Errorf("Invalid match of upgraded exclude. key=%s, expected=%t, actual=%t", key, expected, actual)
+		}
+	}
+
+	state, _ = resourceSiteStateUpgradeV0(map[string]interface{}{"exclude": ""}, nil)
+	if len(state["exclude"].([]interface{})) != 0 {
+		t.Errorf("Invalid upgraded empty exclude: %v", state["exclude"])
+	}
+}
+
+func TestResourceSiteStateUpgradeV1(t *testing.T) {
+	state, err := resourceSiteStateUpgradeV1(map[string]interface{}{
+		"bucket": "bucket",
+		"files": map[string]interface{}{
+			"index%%html":    "a",
+			"static/app%%js": "b",
+		},
+		"metadata_hashes": map[string]interface{}{
+			"index%%html": "c",
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := state["metadata_hashes"]; ok {
+		t.Error("metadata_hashes was not removed")
+	}
+
+	files := state["files"].(map[string]interface{})
+	if len(files) != 2 || files["index%%html"] != "a" || files["static/app%%js"] != "b" {
+		t.Errorf("Invalid upgraded files: %v", files)
+	}
+
+	objects := state["object"].([]interface{})
+	if len(objects) != 2 {
+		t.Fatalf("Invalid upgraded objects: %v", objects)
+	}
+
+	index := objects[0].(map[string]interface{})
+	if index["key"] != "index.html" || index["etag"] != "a" || index["checksum"] != "a" || index["metadata_hash"] != "c" {
+		t.Errorf("Invalid upgraded object: %v", index)
+	}
+
+	app := objects[1].(map[string]interface{})
+	if app["key"] != "static/app.js" || app["etag"] != "b" || app["metadata_hash"] != "" {
+		t.Errorf("Invalid upgraded object: %v", app)
+	}
+}
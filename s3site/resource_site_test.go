@@ -3,7 +3,11 @@ package s3site
 import (
 	"log"
 	"os"
+	"reflect"
 	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
 )
 
 var m map[string]fileInfo
@@ -15,7 +19,7 @@ func TestDecorateMap(t *testing.T) {
 	}
 	fi1 := fileInfo{
 		FullPath:     "../test_resources/index.html",
-		RelativePath: "test",
+		RelativePath: "index.html",
 		FileInfo:     f1,
 	}
 
@@ -25,7 +29,7 @@ func TestDecorateMap(t *testing.T) {
 	}
 	fi2 := fileInfo{
 		FullPath:     "../test_resources/index.js",
-		RelativePath: "test",
+		RelativePath: "index.js",
 		FileInfo:     f2,
 	}
 
@@ -35,7 +39,7 @@ func TestDecorateMap(t *testing.T) {
 	}
 	fi3 := fileInfo{
 		FullPath:     "../test_resources/logo.svg",
-		RelativePath: "test",
+		RelativePath: "logo.svg",
 		FileInfo:     f3,
 	}
 
@@ -45,7 +49,7 @@ func TestDecorateMap(t *testing.T) {
 	}
 	fi4 := fileInfo{
 		FullPath:     "../test_resources/index_compressed.js",
-		RelativePath: "test",
+		RelativePath: "index_compressed.js",
 		FileInfo:     f4,
 	}
 
@@ -55,7 +59,7 @@ func TestDecorateMap(t *testing.T) {
 	m["3"] = fi3
 	m["4"] = fi4
 
-	resultMap := decorateMap(m)
+	resultMap := decorateMap(m, nil)
 	r1 := resultMap["1"]
 	r2 := resultMap["2"]
 	r3 := resultMap["3"]
@@ -89,3 +93,304 @@ func TestDecorateMap(t *testing.T) {
 		t.Error("Invalid ContentEncoding on index_compressed.js")
 	}
 }
+
+func TestDecorateMapObjectRules(t *testing.T) {
+	fileInfoMap := map[string]fileInfo{
+		"index": {FullPath: "../test_resources/index.html", RelativePath: "index.html"},
+		"js":    {FullPath: "../test_resources/index.js", RelativePath: "static/index.js"},
+		"svg":   {FullPath: "../test_resources/logo.svg", RelativePath: "static/logo.svg"},
+	}
+
+	rules := []objectRule{
+		{Pattern: "static/**", CacheControl: "public, max-age=31536000, immutable", Metadata: map[string]string{"team": "web", "tier": "static"}},
+		{Pattern: "**/*.svg", ContentDisposition: "inline", ContentLanguage: "en", Metadata: map[string]string{"tier": "image"}},
+		{Pattern: "**/*.html", CacheControl: "no-cache", ContentType: "text/html; charset=utf-8"},
+	}
+
+	resultMap := decorateMap(fileInfoMap, rules)
+
+	index := resultMap["index"]
+	if index.CacheControl != "no-cache" {
+		t.Errorf("Configured rule did not override the default rule: %s", index.CacheControl)
+	}
+	if index.Expires != "0" {
+		t.Errorf("Default rule Expires was lost: %s", index.Expires)
+	}
+
+	if index.ContentType != "text/html; charset=utf-8" {
+		t.Errorf("Invalid ContentType override: %s", index.ContentType)
+	}
+
+	js := resultMap["js"]
+	if js.CacheControl != "public, max-age=31536000, immutable" || js.Metadata["tier"] != "static" {
+		t.Errorf("Invalid rule result for static/index.js: %+v", js)
+	}
+
+	svg := resultMap["svg"]
+	if svg.ContentType != "image/svg+xml" {
+		t.Errorf("Detected ContentType was lost: %s", svg.ContentType)
+	}
+	if svg.ContentDisposition != "inline" || svg.ContentLanguage != "en" {
+		t.Errorf("Invalid headers for static/logo.svg: %+v", svg)
+	}
+	if svg.Metadata["team"] != "web" || svg.Metadata["tier"] != "image" {
+		t.Errorf("Metadata was not merged: %v", svg.Metadata)
+	}
+
+	expiresRules := []objectRule{
+		{Pattern: "**/index.html", Expires: expiresNone},
+		{Pattern: "static/**", Expires: "3600"},
+	}
+	resultMap = decorateMap(fileInfoMap, expiresRules)
+	if index := resultMap["index"]; index.Expires != "" {
+		t.Errorf("Default rule Expires was not removed: %s", index.Expires)
+	}
+	if js := resultMap["js"]; js.Expires != "3600" {
+		t.Errorf("Invalid Expires for static/index.js: %s", js.Expires)
+	}
+}
+
+func TestDiffObjects(t *testing.T) {
+	oldObjects := map[string]siteObject{
+		"index.html": {Key: "index.html", Checksum: "a", MetadataHash: "m", VersionId: "1"},
+		"app.js":     {Key: "app.js", Checksum: "b", MetadataHash: "m"},
+		"app.css":    {Key: "app.css", Checksum: "c", MetadataHash: "m"},
+		"old.js":     {Key: "old.js", Checksum: "d", MetadataHash: "m"},
+	}
+	newObjects := map[string]siteObject{
+		"index.html": {Key: "index.html", Checksum: "a", ETag: "x", MetadataHash: "m"},
+		"app.js":     {Key: "app.js", Checksum: "e", MetadataHash: "m"},
+		"app.css":    {Key: "app.css", Checksum: "c", MetadataHash: "n"},
+		"new.js":     {Key: "new.js", Checksum: "f", MetadataHash: "m"},
+	}
+
+	changed, removed := diffObjects(oldObjects, newObjects)
+
+	if len(changed) != 3 {
+		t.Errorf("Invalid changed objects: %v", changed)
+	}
+
+	for _, key := range []string{"app.js", "app.css", "new.js"} {
+		if _, ok := changed[key]; !ok {
+			t.Errorf("Missing changed object %s", key)
+		}
+	}
+
+	if len(removed) != 1 || removed[0] != "old.js" {
+		t.Errorf("Invalid removed objects: %v", removed)
+	}
+}
+
+func TestMetadataFingerprint(t *testing.T) {
+	local := fileInfo{
+		ContentType:  "text/html; charset=utf-8",
+		CacheControl: "no-cache",
+		Expires:      "0",
+		Metadata:     map[string]string{"team": "web"},
+	}
+
+	head := headFileInfo(&s3.HeadObjectOutput{
+		ContentType:  aws.String("text/html; charset=utf-8"),
+		CacheControl: aws.String("no-cache"),
+		Metadata:     map[string]*string{"Team": aws.String("web"), "S3site-Expires": aws.String("0")},
+	})
+
+	if local.metadataFingerprint() != head.metadataFingerprint() {
+		t.Error("Fingerprint of uploaded headers does not match the local one")
+	}
+
+	local.Expires = ""
+	if local.metadataFingerprint() == head.metadataFingerprint() {
+		t.Error("Fingerprint did not change with Expires")
+	}
+
+	local.Expires = "0"
+	legacy := &s3.HeadObjectOutput{
+		ContentType:  aws.String("text/html; charset=utf-8"),
+		CacheControl: aws.String("no-cache"),
+		Expires:      aws.String("Fri, 16 Oct 2026 12:00:00 GMT"),
+		Metadata:     map[string]*string{"Team": aws.String("web")},
+	}
+	if local.metadataFingerprint() != headFileInfoExpires(legacy, "0").metadataFingerprint() {
+		t.Error("Fingerprint of an upload without s3site-expires does not match the configured expires")
+	}
+
+	legacy.Expires = nil
+	if local.metadataFingerprint() == headFileInfoExpires(legacy, "0").metadataFingerprint() {
+		t.Error("Fingerprint of an upload without Expires matches the configured expires")
+	}
+
+	local.CacheControl = "max-age=60"
+	if local.metadataFingerprint() == head.metadataFingerprint() {
+		t.Error("Fingerprint did not change with CacheControl")
+	}
+}
+
+func TestMetadataFingerprintEncryption(t *testing.T) {
+	local := fileInfo{
+		ContentType:          "text/html",
+		Hash:                 "d41d8cd98f00b204e9800998ecf8427e",
+		ServerSideEncryption: s3.ServerSideEncryptionAwsKms,
+		SSEKMSKeyId:          "alias/site",
+	}
+
+	uploaded := &s3.HeadObjectOutput{
+		ContentType: aws.String("text/html"),
+		ETag:        aws.String("\"4f0e3bd1c4bd5b5c9b8b1a6e0b9c7d21\""),
+		Metadata: map[string]*string{
+			"S3site-Md5": aws.String("d41d8cd98f00b204e9800998ecf8427e"),
+			"S3site-Sse": aws.String("aws:kms:alias/site"),
+		},
+	}
+
+	if local.metadataFingerprint() != headFileInfo(uploaded).metadataFingerprint() {
+		t.Error("Fingerprint of an encrypted upload does not match the local one")
+	}
+
+	if hash := headMetadata(uploaded, metadataContentHash); hash != local.Hash {
+		t.Errorf("Invalid content hash from metadata: %s", hash)
+	}
+
+	local.SSEKMSKeyId = "alias/other"
+	if local.metadataFingerprint() == headFileInfo(uploaded).metadataFingerprint() {
+		t.Error("Fingerprint did not change with the KMS key")
+	}
+}
+
+func TestApplyObjectRulesStorage(t *testing.T) {
+	rules := []objectRule{
+		{Pattern: "**", ACL: "private", Tags: map[string]string{"cost-center": "web", "release": "42"}},
+		{Pattern: "archive/**", StorageClass: s3.StorageClassIntelligentTiering, Tags: map[string]string{"release": "archive"}},
+		{Pattern: "**/*.html", ACL: "public-read"},
+	}
+
+	archived := applyObjectRules(fileInfo{RelativePath: "archive/data.json"}, rules)
+	if archived.ACL != "private" || archived.StorageClass != s3.StorageClassIntelligentTiering {
+		t.Errorf("Invalid storage settings for archive/data.json: %+v", archived)
+	}
+	if archived.Tags["cost-center"] != "web" || archived.Tags["release"] != "archive" {
+		t.Errorf("Tags were not merged: %v", archived.Tags)
+	}
+
+	index := applyObjectRules(fileInfo{RelativePath: "index.html"}, rules)
+	if index.ACL != "public-read" || index.StorageClass != "" {
+		t.Errorf("Invalid storage settings for index.html: %+v", index)
+	}
+	if index.uploadTagging() != "cost-center=web&release=42" {
+		t.Errorf("Invalid tagging header: %s", index.uploadTagging())
+	}
+}
+
+func TestMetadataFingerprintStorage(t *testing.T) {
+	local := fileInfo{ContentType: "text/html", ACL: "public-read", StorageClass: s3.StorageClassStandard}
+
+	uploaded := &s3.HeadObjectOutput{
+		ContentType: aws.String("text/html"),
+		Metadata:    map[string]*string{"S3site-Acl": aws.String("public-read")},
+	}
+
+	if local.metadataFingerprint() != headFileInfo(uploaded).metadataFingerprint() {
+		t.Error("Fingerprint of a STANDARD upload does not match the local one")
+	}
+
+	local.StorageClass = s3.StorageClassIntelligentTiering
+	if local.metadataFingerprint() == headFileInfo(uploaded).metadataFingerprint() {
+		t.Error("Fingerprint did not change with the storage class")
+	}
+
+	uploaded.StorageClass = aws.String(s3.StorageClassIntelligentTiering)
+	if local.metadataFingerprint() != headFileInfo(uploaded).metadataFingerprint() {
+		t.Error("Fingerprint of an INTELLIGENT_TIERING upload does not match the local one")
+	}
+}
+
+func TestDiffTags(t *testing.T) {
+	tags := tagsFingerprint(map[string]string{"release": "42"})
+
+	oldObjects := map[string]siteObject{
+		"index.html": {Key: "index.html", Checksum: "a", MetadataHash: "m"},
+		"app.js":     {Key: "app.js", Checksum: "b", MetadataHash: "m"},
+		"app.css":    {Key: "app.css", Checksum: "c", MetadataHash: "m", TagsHash: tags},
+	}
+	newObjects := map[string]siteObject{
+		"index.html": {Key: "index.html", Checksum: "a", MetadataHash: "m", TagsHash: tags},
+		"app.js":     {Key: "app.js", Checksum: "e", MetadataHash: "m", TagsHash: tags},
+		"app.css":    {Key: "app.css", Checksum: "c", MetadataHash: "m"},
+	}
+
+	changed, _ := diffObjects(oldObjects, newObjects)
+	retagged := diffTags(oldObjects, newObjects, changed)
+
+	if len(changed) != 1 {
+		t.Errorf("Tag changes caused uploads: %v", changed)
+	}
+
+	if len(retagged) != 2 {
+		t.Errorf("Invalid retagged objects: %v", retagged)
+	}
+
+	for _, key := range []string{"index.html", "app.css"} {
+		if _, ok := retagged[key]; !ok {
+			t.Errorf("Missing retagged object %s", key)
+		}
+	}
+
+	if tagsFingerprint(nil) != "" {
+		t.Error("Fingerprint without tags is not empty")
+	}
+}
+
+func TestSuppressPrefixDiff(t *testing.T) {
+	for _, prefix := range []string{"app/", "/app", "/app/"} {
+		if !suppressPrefixDiff("prefix", "app", prefix, nil) {
+			t.Errorf("Diff not suppressed for prefix %q", prefix)
+		}
+	}
+
+	if suppressPrefixDiff("prefix", "app", "app/1", nil) {
+		t.Error("Diff suppressed for a different prefix")
+	}
+}
+
+func TestManagedDestroyKeys(t *testing.T) {
+	objects := map[string]siteObject{
+		"index.html":      {Key: "index.html"},
+		"app.js":          {Key: "app.js"},
+		"logs/access.log": {Key: "logs/access.log"},
+	}
+	releases := []release{
+		{ID: "2", Objects: []releaseObject{{Key: "index.html"}, {Key: "app.js"}}},
+		{ID: "1", Objects: []releaseObject{{Key: "index.html"}, {Key: "old.js"}}},
+	}
+	retained := []retainedObject{{Key: "old.js"}}
+
+	// Objects no release deployed are kept, retained ones are deleted
+	keys := managedDestroyKeys(objects, releases, retained, false)
+	if expected := []string{"app.js", "index.html", "old.js"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Invalid keys without ownership. expected=%v, actual=%v", expected, keys)
+	}
+
+	// Ownership already limits state to the objects of the site
+	keys = managedDestroyKeys(objects, nil, retained, true)
+	if expected := []string{"app.js", "index.html", "logs/access.log", "old.js"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Invalid keys with ownership. expected=%v, actual=%v", expected, keys)
+	}
+}
+
+func TestUnmanagedDestroyKeys(t *testing.T) {
+	keys := []string{
+		"index.html",
+		"logs/access.log",
+		lockKey,
+		ledgerKey,
+		"preview/index.html",
+		"preview/" + lockKey,
+		"preview/" + releasesDir + "1.json",
+	}
+
+	// Nested sites and the lock are kept, everything else is deleted
+	expected := []string{"index.html", "logs/access.log", ledgerKey}
+	if actual := unmanagedDestroyKeys(keys); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Invalid keys. expected=%v, actual=%v", expected, actual)
+	}
+}
@@ -0,0 +1,225 @@
+package s3site
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/terraform/helper/hashcode"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// siteObject is the state kept for every object of a site. Key is relative to
+// the site prefix.
+type siteObject struct {
+	Key          string
+	ETag         string
+	Checksum     string
+	Size         int64
+	ContentType  string
+	CacheControl string
+	VersionId    string
+	MetadataHash string
+	TagsHash     string
+}
+
+func siteObjectSchema() *schema.Schema {
+	return &schema.Schema{
+		Type:        schema.TypeSet,
+		Computed:    true,
+		Description: "The objects of the site.",
+		Set:         siteObjectHash,
+		Elem: &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"key": {
+					Type:        schema.TypeString,
+					Computed:    true,
+					Description: "Object key relative to `prefix`.",
+				},
+				"etag": {
+					Type:        schema.TypeString,
+					Computed:    true,
+					Description: "ETag of the object in S3.",
+				},
+				"checksum": {
+					Type:        schema.TypeString,
+					Computed:    true,
+					Description: "Content checksum of the object for the configured `checksum_algorithm`.",
+				},
+				"size": {
+					Type:     schema.TypeInt,
+					Computed: true,
+				},
+				"content_type": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				"cache_control": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				"version_id": {
+					Type:        schema.TypeString,
+					Computed:    true,
+					Description: "Version of the object, empty when the bucket is not versioned.",
+				},
+				"metadata_hash": {
+					Type:        schema.TypeString,
+					Computed:    true,
+					Description: "Fingerprint of the headers and metadata of the object.",
+				},
+				"tags_hash": {
+					Type:        schema.TypeString,
+					Computed:    true,
+					Description: "Fingerprint of the tags of the object, empty without tags.",
+				},
+			},
+		},
+	}
+}
+
+// siteObjectHash identifies set elements by everything but the version and
+// ETag, which are only known once an object has been uploaded.
+func siteObjectHash(v interface{}) int {
+	var buf bytes.Buffer
+	m := v.(map[string]interface{})
+	buf.WriteString(fmt.Sprintf("%s-", m["key"].(string)))
+	buf.WriteString(fmt.Sprintf("%s-", m["checksum"].(string)))
+	buf.WriteString(fmt.Sprintf("%d-", m["size"].(int)))
+	buf.WriteString(fmt.Sprintf("%s-", m["content_type"].(string)))
+	buf.WriteString(fmt.Sprintf("%s-", m["cache_control"].(string)))
+	buf.WriteString(fmt.Sprintf("%s-", m["metadata_hash"].(string)))
+	if tagsHash, ok := m["tags_hash"].(string); ok && tagsHash != "" {
+		buf.WriteString(fmt.Sprintf("%s-", tagsHash))
+	}
+
+	return hashcode.String(buf.String())
+}
+
+func expandSiteObjects(v interface{}) map[string]siteObject {
+	objects := make(map[string]siteObject)
+
+	set, ok := v.(*schema.Set)
+	if !ok {
+		return objects
+	}
+
+	for _, raw := range set.List() {
+		m := raw.(map[string]interface{})
+		object := siteObject{
+			Key:          m["key"].(string),
+			ETag:         m["etag"].(string),
+			Checksum:     m["checksum"].(string),
+			Size:         int64(m["size"].(int)),
+			ContentType:  m["content_type"].(string),
+			CacheControl: m["cache_control"].(string),
+			VersionId:    m["version_id"].(string),
+			MetadataHash: m["metadata_hash"].(string),
+			TagsHash:     m["tags_hash"].(string),
+		}
+		objects[object.Key] = object
+	}
+
+	return objects
+}
+
+func flattenSiteObjects(objects map[string]siteObject) []interface{} {
+	keys := sortedObjectKeys(objects)
+
+	list := make([]interface{}, 0, len(objects))
+	for _, key := range keys {
+		object := objects[key]
+		list = append(list, map[string]interface{}{
+			"key":           object.Key,
+			"etag":          object.ETag,
+			"checksum":      object.Checksum,
+			"size":          int(object.Size),
+			"content_type":  object.ContentType,
+			"cache_control": object.CacheControl,
+			"version_id":    object.VersionId,
+			"metadata_hash": object.MetadataHash,
+			"tags_hash":     object.TagsHash,
+		})
+	}
+
+	return list
+}
+
+// flattenSiteFiles builds the legacy `files` map of `%%` encoded keys to
+// checksums from the objects.
+func flattenSiteFiles(objects map[string]siteObject) map[string]interface{} {
+	files := make(map[string]interface{})
+	for key, object := range objects {
+		files[encodeKey(key)] = object.Checksum
+	}
+
+	return files
+}
+
+// setSiteObjects stores the objects in `object` and the legacy `files` with
+// set, either ResourceData.Set or ResourceDiff.SetNew.
+func setSiteObjects(set func(key string, value interface{}) error, objects map[string]siteObject) {
+	set("object", flattenSiteObjects(objects))
+	set("files", flattenSiteFiles(objects))
+}
+
+func sortedObjectKeys(objects map[string]siteObject) []string {
+	keys := make([]string, 0, len(objects))
+	for key := range objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func filterObjects(objects map[string]siteObject, filter keyFilter) map[string]siteObject {
+	filtered := make(map[string]siteObject)
+	for key, object := range objects {
+		if !filter.match(key) {
+			continue
+		}
+		filtered[key] = object
+	}
+
+	return filtered
+}
+
+// diffObjects compares the objects in state with the planned ones. It returns
+// the planned objects that are new or whose content or headers changed, and
+// the keys of the objects that no longer exist.
+func diffObjects(oldObjects map[string]siteObject, newObjects map[string]siteObject) (map[string]siteObject, []string) {
+	changed := make(map[string]siteObject)
+	for key, object := range newObjects {
+		if oldObject, ok := oldObjects[key]; ok && oldObject.Checksum == object.Checksum && oldObject.MetadataHash == object.MetadataHash {
+			continue
+		}
+		changed[key] = object
+	}
+
+	var removed []string
+	for key := range oldObjects {
+		if _, ok := newObjects[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+	sort.Strings(removed)
+
+	return changed, removed
+}
+
+// diffTags returns the planned objects that are not uploaded again but whose
+// tags changed, so their tags can be replaced in place.
+func diffTags(oldObjects map[string]siteObject, newObjects map[string]siteObject, changed map[string]siteObject) map[string]siteObject {
+	retagged := make(map[string]siteObject)
+	for key, object := range newObjects {
+		if _, ok := changed[key]; ok {
+			continue
+		}
+		if oldObject, ok := oldObjects[key]; ok && oldObject.TagsHash != object.TagsHash {
+			retagged[key] = object
+		}
+	}
+
+	return retagged
+}
@@ -0,0 +1,386 @@
+package s3site
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+	"golang.org/x/crypto/blake2b"
+)
+
+// artifactCheck verifies an artifact before it is used. The expected SHA-256
+// and the detached signature are each optional; a signature must match one of
+// PublicKeys.
+type artifactCheck struct {
+	SHA256     string
+	Signature  string
+	PublicKeys []string
+}
+
+func (c artifactCheck) enabled() bool {
+	return c.SHA256 != "" || c.Signature != ""
+}
+
+// validate reports an incomplete signature configuration. signatureAttribute
+// names the attribute holding the signature for the error message.
+func (c artifactCheck) validate(signatureAttribute string) error {
+	if c.Signature != "" && len(c.PublicKeys) == 0 {
+		return fmt.Errorf("`%s` requires `public_keys`", signatureAttribute)
+	}
+	if c.Signature == "" && len(c.PublicKeys) > 0 {
+		return fmt.Errorf("`public_keys` requires `%s`", signatureAttribute)
+	}
+
+	for i, key := range c.PublicKeys {
+		if _, err := parsePublicKey(key); err != nil {
+			return fmt.Errorf("public_keys.%d: %s", i, err)
+		}
+	}
+
+	return nil
+}
+
+// verify checks the artifact at path against the expected SHA-256 and the
+// signature at c.Signature.
+func (c artifactCheck) verify(path string) error {
+	if !c.enabled() {
+		return nil
+	}
+
+	if c.SHA256 != "" {
+		digest, err := fileDigest(path, sha256.New())
+		if err != nil {
+			return err
+		}
+
+		actual := fmt.Sprintf("%x", digest)
+		if !strings.EqualFold(actual, strings.TrimSpace(c.SHA256)) {
+			return fmt.Errorf("%s: SHA-256 %s does not match `expected_sha256` %s", path, actual, c.SHA256)
+		}
+		log.Printf("[DEBUG] Verified SHA-256. path=%s, sha256=%s", path, actual)
+	}
+
+	if c.Signature != "" {
+		signature, err := ioutil.ReadFile(c.Signature)
+		if err != nil {
+			return fmt.Errorf("error reading signature %s: %s", c.Signature, err)
+		}
+
+		for i, raw := range c.PublicKeys {
+			key, err := parsePublicKey(raw)
+			if err != nil {
+				return fmt.Errorf("public_keys.%d: %s", i, err)
+			}
+
+			if err := key.verify(path, signature); err != nil {
+				log.Printf("[DEBUG] Signature does not match key. path=%s, key=%d, err=%s", path, i, err)
+				continue
+			}
+
+			log.Printf("[DEBUG] Verified signature. path=%s, signature=%s, key=%d", path, c.Signature, i)
+			return nil
+		}
+
+		return fmt.Errorf("%s: signature %s does not match any of the `public_keys`", path, c.Signature)
+	}
+
+	return nil
+}
+
+// siteArtifactCheck returns the checks of the archive at `path`.
+func siteArtifactCheck(d resourceGetter) artifactCheck {
+	return artifactCheck{
+		SHA256:     d.Get("expected_sha256").(string),
+		Signature:  d.Get("signature_path").(string),
+		PublicKeys: expandStringList(d.Get("public_keys").([]interface{})),
+	}
+}
+
+// downloadVerified downloads artifact to localPath and the detached signature
+// named by signatureAttribute next to it, then verifies the download with the
+// checks configured on the data source. download fetches a single object of the
+// source. Both are downloaded to temporary files and only renamed into place
+// once verified, so concurrent reads never see a partial or unverified file.
+// It returns the local path of the signature, empty when there is none.
+func downloadVerified(data resourceGetter, signatureAttribute string, artifact string, localPath string,
+	download func(source string, localPath string) error) (string, error) {
+	signature := data.Get(signatureAttribute).(string)
+
+	check := artifactCheck{
+		SHA256:     data.Get("expected_sha256").(string),
+		PublicKeys: expandStringList(data.Get("public_keys").([]interface{})),
+	}
+	if signature != "" {
+		check.Signature = localPath + ".sig"
+	}
+	if err := check.validate(signatureAttribute); err != nil {
+		return "", err
+	}
+
+	tempArtifact, err := downloadTemp(artifact, localPath, download)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tempArtifact)
+
+	tempCheck := check
+	if signature != "" {
+		tempSignature, err := downloadTemp(signature, check.Signature, download)
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(tempSignature)
+		tempCheck.Signature = tempSignature
+	}
+
+	if err := tempCheck.verify(tempArtifact); err != nil {
+		return "", err
+	}
+
+	if signature != "" {
+		if err := os.Rename(tempCheck.Signature, check.Signature); err != nil {
+			return "", fmt.Errorf("error moving signature to %s: %s", check.Signature, err)
+		}
+	}
+	if err := os.Rename(tempArtifact, localPath); err != nil {
+		return "", fmt.Errorf("error moving artifact to %s: %s", localPath, err)
+	}
+
+	return check.Signature, nil
+}
+
+// downloadTemp downloads source to a new temporary file next to localPath and
+// returns its path. The file is removed when the download fails.
+func downloadTemp(source string, localPath string, download func(source string, localPath string) error) (string, error) {
+	file, err := ioutil.TempFile(filepath.Dir(localPath), "."+filepath.Base(localPath)+"-")
+	if err != nil {
+		return "", fmt.Errorf("error creating temporary file for %s: %s", localPath, err)
+	}
+	file.Close()
+
+	if err := download(source, file.Name()); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	return file.Name(), nil
+}
+
+// artifactCheckSchema returns the attributes shared by every source that can
+// be verified. The attribute locating the signature differs per source.
+func artifactCheckSchema() map[string]*schema.Schema {
+	return map[string]*schema.Schema{
+		"expected_sha256": {
+			Type:         schema.TypeString,
+			Optional:     true,
+			Description:  "Hex encoded SHA-256 the artifact must have.",
+			ValidateFunc: validation.StringMatch(regexp.MustCompile(`^[0-9a-fA-F]{64}$`), "must be a hex encoded SHA-256"),
+		},
+		"public_keys": {
+			Type:     schema.TypeList,
+			Optional: true,
+			Elem:     &schema.Schema{Type: schema.TypeString},
+			Description: "Public keys accepted for the detached signature: ed25519 or ECDSA P-256 (cosign) keys " +
+				"in PEM, base64 encoded raw ed25519 keys or minisign public keys.",
+		},
+	}
+}
+
+// publicKey verifies detached signatures of an artifact.
+type publicKey interface {
+	verify(path string, signature []byte) error
+}
+
+// parsePublicKey accepts PEM encoded ed25519 and ECDSA P-256 keys, minisign
+// public keys and base64 encoded raw ed25519 keys.
+func parsePublicKey(s string) (publicKey, error) {
+	s = strings.TrimSpace(s)
+
+	if block, _ := pem.Decode([]byte(s)); block != nil {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PEM public key: %s", err)
+		}
+
+		switch key := key.(type) {
+		case ed25519.PublicKey:
+			return ed25519Key(key), nil
+		case *ecdsa.PublicKey:
+			if key.Curve != elliptic.P256() {
+				return nil, fmt.Errorf("unsupported ECDSA curve %s, only P-256 is supported", key.Curve.Params().Name)
+			}
+			return ecdsaKey{key}, nil
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T", key)
+		}
+	}
+
+	b, err := base64.StdEncoding.DecodeString(stripComments(s))
+	if err != nil {
+		return nil, fmt.Errorf("public key is neither PEM nor base64: %s", err)
+	}
+
+	switch {
+	case len(b) == ed25519.PublicKeySize:
+		return ed25519Key(b), nil
+	case len(b) == 2+8+ed25519.PublicKeySize && string(b[:2]) == "Ed":
+		key := minisignKey{key: ed25519.PublicKey(b[10:])}
+		copy(key.id[:], b[2:10])
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key of %d bytes", len(b))
+	}
+}
+
+// stripComments drops the comment lines minisign adds to keys and signatures.
+func stripComments(s string) string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "untrusted comment:") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "")
+}
+
+// decodeSignature returns a signature stored either raw or base64 encoded.
+func decodeSignature(signature []byte) []byte {
+	if b, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(signature))); err == nil {
+		return b
+	}
+
+	return signature
+}
+
+// ed25519Key verifies ed25519 signatures over the artifact content.
+type ed25519Key ed25519.PublicKey
+
+func (k ed25519Key) verify(path string, signature []byte) error {
+	signature = decodeSignature(signature)
+	if len(signature) != ed25519.SignatureSize {
+		return fmt.Errorf("not an ed25519 signature")
+	}
+
+	message, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(ed25519.PublicKey(k), message, signature) {
+		return fmt.Errorf("invalid ed25519 signature")
+	}
+
+	return nil
+}
+
+// ecdsaKey verifies ASN.1 encoded ECDSA signatures over the SHA-256 of the
+// artifact, as created by `cosign sign-blob`.
+type ecdsaKey struct {
+	key *ecdsa.PublicKey
+}
+
+func (k ecdsaKey) verify(path string, signature []byte) error {
+	digest, err := fileDigest(path, sha256.New())
+	if err != nil {
+		return err
+	}
+
+	if !ecdsa.VerifyASN1(k.key, digest, decodeSignature(signature)) {
+		return fmt.Errorf("invalid ECDSA signature")
+	}
+
+	return nil
+}
+
+// minisignKey verifies minisign signatures, both legacy ones over the artifact
+// content and prehashed ones over its BLAKE2b-512.
+type minisignKey struct {
+	id  [8]byte
+	key ed25519.PublicKey
+}
+
+func (k minisignKey) verify(path string, signature []byte) error {
+	var lines []string
+	for _, line := range strings.Split(string(signature), "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "untrusted comment:") || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return fmt.Errorf("not a minisign signature")
+	}
+
+	b, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(b) != 2+8+ed25519.SignatureSize {
+		return fmt.Errorf("invalid minisign signature")
+	}
+	if !bytes.Equal(b[2:10], k.id[:]) {
+		return fmt.Errorf("minisign signature was made by key %X, not %X", b[2:10], k.id[:])
+	}
+	sig := b[10:]
+
+	var message []byte
+	switch string(b[:2]) {
+	case "Ed":
+		message, err = ioutil.ReadFile(path)
+	case "ED":
+		var h hash.Hash
+		if h, err = blake2b.New512(nil); err == nil {
+			message, err = fileDigest(path, h)
+		}
+	default:
+		return fmt.Errorf("unsupported minisign signature algorithm %q", b[:2])
+	}
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(k.key, message, sig) {
+		return fmt.Errorf("invalid minisign signature")
+	}
+
+	// The global signature covers the trusted comment
+	globalSig, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return fmt.Errorf("invalid minisign global signature")
+	}
+	trustedComment := strings.TrimPrefix(lines[2], "trusted comment: ")
+	if !ed25519.Verify(k.key, append(append([]byte{}, sig...), trustedComment...), globalSig) {
+		return fmt.Errorf("invalid minisign trusted comment signature")
+	}
+
+	return nil
+}
+
+func fileDigest(path string, h hash.Hash) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(h, file); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
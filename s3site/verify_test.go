@@ -0,0 +1,230 @@
+package s3site
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"golang.org/x/crypto/blake2b"
+)
+
+func writeTestFile(t *testing.T, path string, content []byte) string {
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func pemPublicKey(t *testing.T, key interface{}) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// minisignSignature signs message like minisign does with the key id keyId.
+func minisignSignature(private ed25519.PrivateKey, keyId []byte, message []byte, prehashed bool) string {
+	algorithm := "Ed"
+	if prehashed {
+		algorithm = "ED"
+		digest := blake2b.Sum512(message)
+		message = digest[:]
+	}
+
+	sig := ed25519.Sign(private, message)
+	trustedComment := "timestamp:1600000000\tfile:site.zip"
+	globalSig := ed25519.Sign(private, append(append([]byte{}, sig...), trustedComment...))
+
+	return fmt.Sprintf("untrusted comment: signature from minisign secret key\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(append(append([]byte(algorithm), keyId...), sig...)),
+		trustedComment,
+		base64.StdEncoding.EncodeToString(globalSig))
+}
+
+func TestArtifactCheckVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3site-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := []byte("site archive")
+	artifact := writeTestFile(t, filepath.Join(dir, "site.zip"), content)
+
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublic, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecPrivate, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(content)
+	ecSignature, err := ecdsa.SignASN1(rand.Reader, ecPrivate, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyId := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	minisignPublic := "untrusted comment: minisign public key 0807060504030201\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), keyId...), edPublic...))
+
+	edSignature := ed25519.Sign(edPrivate, content)
+	signatures := map[string][]byte{
+		"ed25519.raw":      edSignature,
+		"ed25519.b64":      []byte(base64.StdEncoding.EncodeToString(edSignature) + "\n"),
+		"cosign.sig":       []byte(base64.StdEncoding.EncodeToString(ecSignature)),
+		"minisign.sig":     []byte(minisignSignature(edPrivate, keyId, content, false)),
+		"minisign-ed.sig":  []byte(minisignSignature(edPrivate, keyId, content, true)),
+		"minisign-bad.sig": []byte(minisignSignature(edPrivate, keyId, []byte("other archive"), true)),
+	}
+	for name, signature := range signatures {
+		writeTestFile(t, filepath.Join(dir, name), signature)
+	}
+
+	cases := []struct {
+		name    string
+		check   artifactCheck
+		message string
+	}{
+		{"no checks", artifactCheck{}, ""},
+		{"sha256", artifactCheck{SHA256: strings.ToUpper(fmt.Sprintf("%x", digest))}, ""},
+		{"sha256 mismatch", artifactCheck{SHA256: strings.Repeat("0", 64)}, "does not match `expected_sha256`"},
+		{"ed25519 raw", artifactCheck{Signature: "ed25519.raw", PublicKeys: []string{base64.StdEncoding.EncodeToString(edPublic)}}, ""},
+		{"ed25519 pem", artifactCheck{Signature: "ed25519.b64", PublicKeys: []string{pemPublicKey(t, edPublic)}}, ""},
+		{"ed25519 second key", artifactCheck{Signature: "ed25519.b64", PublicKeys: []string{pemPublicKey(t, otherPublic), pemPublicKey(t, edPublic)}}, ""},
+		{"ed25519 wrong key", artifactCheck{Signature: "ed25519.b64", PublicKeys: []string{pemPublicKey(t, otherPublic)}}, "does not match any"},
+		{"cosign", artifactCheck{Signature: "cosign.sig", PublicKeys: []string{pemPublicKey(t, &ecPrivate.PublicKey)}}, ""},
+		{"cosign wrong type", artifactCheck{Signature: "cosign.sig", PublicKeys: []string{pemPublicKey(t, edPublic)}}, "does not match any"},
+		{"minisign legacy", artifactCheck{Signature: "minisign.sig", PublicKeys: []string{minisignPublic}}, ""},
+		{"minisign prehashed", artifactCheck{Signature: "minisign-ed.sig", PublicKeys: []string{minisignPublic}}, ""},
+		{"minisign tampered", artifactCheck{Signature: "minisign-bad.sig", PublicKeys: []string{minisignPublic}}, "does not match any"},
+		{"missing signature", artifactCheck{Signature: "missing.sig", PublicKeys: []string{minisignPublic}}, "error reading signature"},
+	}
+
+	for _, c := range cases {
+		if c.check.Signature != "" {
+			c.check.Signature = filepath.Join(dir, c.check.Signature)
+		}
+
+		err := c.check.verify(artifact)
+		if c.message == "" && err != nil {
+			t.Errorf("Unexpected error for %s: %s", c.name, err)
+		} else if c.message != "" && (err == nil || !strings.Contains(err.Error(), c.message)) {
+			t.Errorf("Invalid error for %s. expected=%s, actual=%v", c.name, c.message, err)
+		}
+	}
+}
+
+func TestArtifactCheckValidate(t *testing.T) {
+	ecPrivate, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		check   artifactCheck
+		message string
+	}{
+		{"signature without keys", artifactCheck{Signature: "site.sig"}, "`signature_path` requires `public_keys`"},
+		{"keys without signature", artifactCheck{PublicKeys: []string{strings.Repeat("A", 44)}}, "`public_keys` requires `signature_path`"},
+		{"invalid key", artifactCheck{Signature: "site.sig", PublicKeys: []string{"not a key"}}, "public_keys.0"},
+		{"unsupported curve", artifactCheck{Signature: "site.sig", PublicKeys: []string{pemPublicKey(t, &ecPrivate.PublicKey)}}, "only P-256"},
+	}
+
+	for _, c := range cases {
+		err := c.check.validate("signature_path")
+		if err == nil || !strings.Contains(err.Error(), c.message) {
+			t.Errorf("Invalid error for %s. expected=%s, actual=%v", c.name, c.message, err)
+		}
+	}
+}
+
+func TestDownloadVerified(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3site-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("site archive")
+	sources := map[string][]byte{
+		"site.zip":     content,
+		"site.zip.sig": []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(private, content))),
+		"other.sig":    []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(private, []byte("other archive")))),
+	}
+	download := func(source string, localPath string) error {
+		return ioutil.WriteFile(localPath, sources[source], 0644)
+	}
+	digest := sha256.Sum256(content)
+
+	cases := []struct {
+		name      string
+		raw       map[string]interface{}
+		signature bool
+		message   string
+	}{
+		{"no checks", map[string]interface{}{}, false, ""},
+		{"sha256", map[string]interface{}{"expected_sha256": fmt.Sprintf("%x", digest)}, false, ""},
+		{"sha256 mismatch", map[string]interface{}{"expected_sha256": strings.Repeat("0", 64)}, false, "expected_sha256"},
+		{"signature", map[string]interface{}{"signature_key": "site.zip.sig", "public_keys": []interface{}{pemPublicKey(t, public)}}, true, ""},
+		{"signature mismatch", map[string]interface{}{"signature_key": "other.sig", "public_keys": []interface{}{pemPublicKey(t, public)}}, false, "does not match any"},
+		{"signature without keys", map[string]interface{}{"signature_key": "site.zip.sig"}, false, "`signature_key` requires `public_keys`"},
+	}
+
+	for _, c := range cases {
+		data := schema.TestResourceDataRaw(t, dataSourceS3().Schema, c.raw)
+		localPath := filepath.Join(dir, strings.Replace(c.name, " ", "-", -1)+".zip")
+
+		signaturePath, err := downloadVerified(data, "signature_key", "site.zip", localPath, download)
+		if c.message == "" && err != nil {
+			t.Errorf("Unexpected error for %s: %s", c.name, err)
+		} else if c.message != "" && (err == nil || !strings.Contains(err.Error(), c.message)) {
+			t.Errorf("Invalid error for %s. expected=%s, actual=%v", c.name, c.message, err)
+		}
+
+		if _, statErr := os.Stat(localPath); (statErr == nil) != (err == nil) {
+			t.Errorf("Download of %s kept=%t, error=%v", c.name, statErr == nil, err)
+		}
+
+		if (signaturePath != "") != c.signature {
+			t.Errorf("Invalid signature path for %s: %q", c.name, signaturePath)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			t.Errorf("Temporary download %s was left behind", entry.Name())
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package s3site
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultWorkDir is used when the provider does not configure `work_dir`.
+func defaultWorkDir() string {
+	return filepath.Join(os.TempDir(), "s3site")
+}
+
+// newWorkspace creates a fresh, uniquely named directory below workDir. The
+// returned cleanup function removes it with everything extracted into it.
+func newWorkspace(workDir string, name string) (string, func(), error) {
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		return "", nil, fmt.Errorf("error creating work directory %s: %s", workDir, err)
+	}
+
+	dir, err := ioutil.TempDir(workDir, name+"-")
+	if err != nil {
+		return "", nil, fmt.Errorf("error creating workspace in %s: %s", workDir, err)
+	}
+
+	log.Printf("[DEBUG] Created workspace. path=%s", dir)
+
+	cleanup := func() {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("[WARN] Unable to remove workspace. path=%s, err=%s", dir, err)
+		}
+	}
+
+	return dir, cleanup, nil
+}
+
+// Download directories not written to for this long are removed by later reads
+const downloadRetention = 24 * time.Hour
+
+// downloadWorkspace returns the directory dedicated to the data source
+// identified by id. The directory is stable so the exported path only changes
+// with the data source. Downloads must outlive the read so a later apply,
+// possibly from a saved plan, can deploy them; directories of data sources not
+// read for downloadRetention are removed.
+func downloadWorkspace(workDir string, id string) (string, error) {
+	removeStaleDownloads(workDir, time.Now().Add(-downloadRetention))
+
+	sum := sha256.Sum256([]byte(id))
+	dir := filepath.Join(workDir, fmt.Sprintf("download-%x", sum[:8]))
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("error creating download directory %s: %s", dir, err)
+	}
+
+	// Keep a directory that is read again from being removed as stale
+	now := time.Now()
+	if err := os.Chtimes(dir, now, now); err != nil {
+		return "", fmt.Errorf("error updating download directory %s: %s", dir, err)
+	}
+
+	return dir, nil
+}
+
+// removeStaleDownloads removes the download directories below workDir last
+// modified before cutoff.
+func removeStaleDownloads(workDir string, cutoff time.Time) {
+	entries, err := ioutil.ReadDir(workDir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "download-") || !entry.ModTime().Before(cutoff) {
+			continue
+		}
+
+		dir := filepath.Join(workDir, entry.Name())
+		log.Printf("[DEBUG] Removing stale download directory. path=%s", dir)
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("[WARN] Unable to remove stale download directory. path=%s, err=%s", dir, err)
+		}
+	}
+}
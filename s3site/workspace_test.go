@@ -0,0 +1,56 @@
+package s3site
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDownloadWorkspace(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "s3site-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	first, err := downloadWorkspace(workDir, "s3://bucket/site.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(first, "site.zip"), []byte("site"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stale := filepath.Join(workDir, "download-stale")
+	if err := os.Mkdir(stale, 0755); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * downloadRetention)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := downloadWorkspace(workDir, "s3://bucket/site.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := downloadWorkspace(workDir, "s3://bucket/other.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first != again {
+		t.Errorf("Reads of the same data source use different directories. first=%s, again=%s", first, again)
+	}
+	if first == other {
+		t.Errorf("Data sources share the directory %s", first)
+	}
+	if _, err := os.Stat(filepath.Join(first, "site.zip")); err != nil {
+		t.Errorf("Recent download was removed: %s", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("Stale download directory was kept: %v", err)
+	}
+}